@@ -1,26 +1,125 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 // We're using the open API from Oslo Bysykkel
 // See https://oslobysykkel.no/apne-data/sanntid
+// Bergen and Trondheim are run by the same operator, and publish the same feeds.
 
 const (
-	updateInterval            = 10 * time.Second
-	requestTimeout            = 10 * time.Second
-	clientIdentifier          = "test-test"
-	stationInformationAddress = "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json"
-	stationStatusAddress      = "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json"
+	defaultUpdateInterval   = 10 * time.Second
+	defaultRequestTimeout   = 10 * time.Second
+	defaultClientIdentifier = "test-test"
+	defaultProvider         = "oslo"
+	defaultLanguage         = "nb"
+	earthRadiusMeters       = 6371000
+	defaultNearestCount     = 5
+
+	// We warn the user when the last_updated times of the two feeds are further apart than this
+	maxFeedSkew = 5 * time.Minute
+
+	// The data is considered stale when it is older than this many update intervals
+	staleIntervals = 3
+
+	// We never wait longer than this many update intervals, however long a Retry-After header asks us to
+	maxRetryAfterIntervals = 5
+
+	// A station that hasn't reported for this long before the feed was updated may have a broken sensor
+	maxReportAge = time.Hour
+)
+
+// provider is a bike share system, and where to find its GBFS feeds
+type provider struct {
+	Name                      string
+	DiscoveryAddress          string
+	SystemInformationAddress  string
+	StationInformationAddress string
+	StationStatusAddress      string
+}
+
+// withFeeds returns a copy of the provider using the given feed URLs by feed name, if any,
+// e.g. the ones found by discoverFeeds or given on the command line
+func (p provider) withFeeds(feeds map[string]string) provider {
+	if url, exists := feeds["system_information"]; exists {
+		p.SystemInformationAddress = url
+	}
+	if url, exists := feeds["station_information"]; exists {
+		p.StationInformationAddress = url
+	}
+	if url, exists := feeds["station_status"]; exists {
+		p.StationStatusAddress = url
+	}
+	return p
+}
+
+var providers = map[string]provider{
+	"oslo": {
+		Name:                      "Oslo BySykkel",
+		DiscoveryAddress:          "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
+		SystemInformationAddress:  "https://gbfs.urbansharing.com/oslobysykkel.no/system_information.json",
+		StationInformationAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+		StationStatusAddress:      "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+	},
+	"bergen": {
+		Name:                      "Bergen Bysykkel",
+		DiscoveryAddress:          "https://gbfs.urbansharing.com/bergenbysykkel.no/gbfs.json",
+		SystemInformationAddress:  "https://gbfs.urbansharing.com/bergenbysykkel.no/system_information.json",
+		StationInformationAddress: "https://gbfs.urbansharing.com/bergenbysykkel.no/station_information.json",
+		StationStatusAddress:      "https://gbfs.urbansharing.com/bergenbysykkel.no/station_status.json",
+	},
+	"trondheim": {
+		Name:                      "Trondheim Bysykkel",
+		DiscoveryAddress:          "https://gbfs.urbansharing.com/trondheimbysykkel.no/gbfs.json",
+		SystemInformationAddress:  "https://gbfs.urbansharing.com/trondheimbysykkel.no/system_information.json",
+		StationInformationAddress: "https://gbfs.urbansharing.com/trondheimbysykkel.no/station_information.json",
+		StationStatusAddress:      "https://gbfs.urbansharing.com/trondheimbysykkel.no/station_status.json",
+	},
+}
+
+// The last response per url, so we can ask the servers to only send data that has changed.
+// The two feeds are fetched concurrently, hence the mutex.
+var (
+	responseCacheMutex sync.Mutex
+	responseCache      = make(map[string]cachedResponse)
+)
+
+// Set when building, e.g. go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse --short HEAD)"
+var version, commit, buildTime string
+
+// Retries of failed fetches. These are variables so the tests can turn them down.
+var (
+	fetchAttempts    = 3
+	fetchBackoffBase = 200 * time.Millisecond
 )
 
 var (
@@ -28,6 +127,31 @@ var (
 	app    *tview.Application
 	frame  *tview.Frame
 	table  *tview.Table
+	search *tview.InputField
+
+	// Set from the command line before the UI starts, read-only afterwards.
+	// When userPosition is nil we show all stations.
+	clientIdentifier = defaultClientIdentifier
+	selectedProvider = providers[defaultProvider]
+	updateInterval   = positiveDuration(defaultUpdateInterval)
+	requestTimeout   = positiveDuration(defaultRequestTimeout)
+	userPosition     *position
+	nearestCount     int
+	allowPartial     bool
+	cacheFile        string
+	favoriteIDs      stationIDs
+
+	// The state below is only touched from the tview event loop
+	// (input capture and QueueUpdateDraw), so it needs no locking.
+	currentStations      []stationData
+	currentUpdated       time.Time
+	currentMessage       string
+	currentFilter        stationFilter
+	currentSort          sortOrder
+	currentChanged       map[string]bool
+	lastSuccessfulUpdate time.Time
+	systemData           gbfsSystemInformationData
+	systemLocation       = time.Local
 )
 
 // The 'gbfs' structures are mapped from the General Bikeshare Feed Specification
@@ -36,6 +160,35 @@ var (
 // If we were to support other providers, we could consider creating a 'gbfs' package
 // that would implement the spec with all the related structures and functions.
 
+type gbfsFeed struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type gbfsDiscoveryLanguage struct {
+	Feeds []gbfsFeed `json:"feeds"`
+}
+
+type gbfsDiscovery struct {
+	LastUpdated int64                            `json:"last_updated"`
+	Data        map[string]gbfsDiscoveryLanguage `json:"data"`
+}
+
+type gbfsSystemInformationData struct {
+	SystemID    string `json:"system_id"`
+	Language    string `json:"language"`
+	Name        string `json:"name"`
+	Operator    string `json:"operator"`
+	Timezone    string `json:"timezone"`
+	PhoneNumber string `json:"phone_number"`
+	Email       string `json:"email"`
+}
+
+type gbfsSystemInformation struct {
+	LastUpdated int64                     `json:"last_updated"`
+	Data        gbfsSystemInformationData `json:"data"`
+}
+
 type gbfsStationInformationStation struct {
 	StationID string  `json:"station_id"`
 	Name      string  `json:"name"`
@@ -46,7 +199,7 @@ type gbfsStationInformationStation struct {
 }
 
 type gbfsStationInformationData struct {
-	Stations []gbfsStationInformationStation `json: "stations"`
+	Stations []gbfsStationInformationStation `json:"stations"`
 }
 
 type gbfsStationInformation struct {
@@ -67,7 +220,33 @@ type gbfsStationStatusStation struct {
 }
 
 type gbfsStationStatusData struct {
-	Stations []gbfsStationStatusStation `json:"stations"`
+	Stations  []gbfsStationStatusStation `json:"stations"`
+	Malformed int                        `json:"-"` // stations skipped by UnmarshalJSON
+}
+
+// UnmarshalJSON parses one station at a time, so a station with a malformed field
+// is skipped (and shown as missing status) instead of failing the whole feed.
+func (d *gbfsStationStatusData) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Stations []json.RawMessage `json:"stations"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*d = gbfsStationStatusData{}
+	if raw.Stations != nil {
+		d.Stations = make([]gbfsStationStatusStation, 0, len(raw.Stations))
+	}
+	for _, rawStation := range raw.Stations {
+		var station gbfsStationStatusStation
+		if err := json.Unmarshal(rawStation, &station); err != nil {
+			d.Malformed++
+			continue
+		}
+		d.Stations = append(d.Stations, station)
+	}
+	return nil
 }
 
 type gbfsStationStatus struct {
@@ -75,191 +254,1337 @@ type gbfsStationStatus struct {
 	Data        gbfsStationStatusData `json:"data"`
 }
 
-type stationInformationResult struct {
-	Information gbfsStationInformation
-	Error       error
+// httpStatusError is a response other than 200 OK.
+// RetryAfter is how long a 429 Too Many Requests asks us to wait, if it says so.
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("Http GET to %s failed with status code %d", e.URL, e.StatusCode)
+}
+
+// fetchTimeoutError is returned by fetchData when the fetches together took too long,
+// so a slow API can be told apart from one that answers with errors.
+type fetchTimeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *fetchTimeoutError) Error() string {
+	return fmt.Sprintf("Fetching the data took longer than %s: %s", e.Timeout, e.Err)
+}
+
+// Unwrap gives callers the error from the fetch that was cut short, e.g. a *url.Error
+func (e *fetchTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets callers check for a timeout with errors.Is(err, context.DeadlineExceeded),
+// even when the fetch that was cut short failed with another error
+func (e *fetchTimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
 }
 
-type stationStatusResult struct {
-	Status gbfsStationStatus
-	Error  error
+// cachedResponse is the last response for a url, kept for conditional requests
+type cachedResponse struct {
+	ETag         string
+	LastModified string
+	Body         []byte
 }
 
 type stationData struct {
+	StationID              string
 	Name                   string
+	Address                string
 	NumberOfBikesAvailable int
 	NumberOfDocksAvailable int
+	NumberOfBikesDisabled  int
+	NumberOfDocksDisabled  int
+	Capacity               int
+	Latitude               float64
+	Longitude              float64
+	IsInstalled            bool
+	IsRenting              bool
+	IsReturning            bool
+	StatusMissing          bool // only set by fetchData with allowPartial, when the status feed failed
+	LastReported           time.Time
+}
+
+// fetchStats describes the result of merging the two feeds in fetchData.
+// DuplicateStations counts station IDs found more than once in either feed, and
+// MalformedStations the status entries we couldn't parse (those stations are also missing status).
+// LastUpdated is the last_updated time of the oldest of the two feeds,
+// and FeedSkew is how far apart the last_updated times of the two feeds are.
+// StatusFailed is set when allowPartial let us return the stations without status,
+// and then LastUpdated is zero, since we don't know how fresh the availability is.
+type fetchStats struct {
+	StatusFailed      bool
+	TotalStations     int
+	MissingStatus     int
+	DuplicateStations int
+	MalformedStations int
+	LastUpdated       time.Time
+	FeedSkew          time.Duration
+}
+
+// stationSummary is a system-wide snapshot of all stations
+type stationSummary struct {
+	Stations       int
+	BikesAvailable int
+	DocksAvailable int
+	Capacity       int
+	Empty          int
+	Full           int
+}
+
+// stationFilter is what the user wants to see. MinBikes and MinDocks are set
+// from the command line, the rest can be changed while the UI is running.
+// All enabled filters must match for a station to be shown, except Empty and Full,
+// which together show the stations that are either empty or full.
+type stationFilter struct {
+	HasBikes bool
+	HasDocks bool
+	Empty    bool
+	Full     bool
+	MinBikes int
+	MinDocks int
+	Query    string
+}
+
+type sortOrder int
+
+// sortByDistance is only available when the user has given us their position,
+// and sortAsGiven, the order of the -ids flag, when the user has picked some stations.
+const (
+	sortByName sortOrder = iota
+	sortByBikes
+	sortByDocks
+	sortByEmptiest
+	sortByFullest
+	sortByDistance
+	sortAsGiven
+)
+
+var sortOrderNames = map[sortOrder]string{
+	sortByName:     "navn",
+	sortByBikes:    "ledige sykler",
+	sortByDocks:    "ledige låser",
+	sortByEmptiest: "tommest",
+	sortByFullest:  "fullest",
+	sortByDistance: "avstand",
+	sortAsGiven:    "som valgt",
+}
+
+// nextSortOrder is the sort order after current, skipping the ones that aren't available
+func nextSortOrder(current sortOrder, hasPosition, hasIDs bool) sortOrder {
+	next := current
+	for {
+		next = (next + 1) % sortOrder(len(sortOrderNames))
+		if (next != sortByDistance || hasPosition) && (next != sortAsGiven || hasIDs) {
+			return next
+		}
+	}
+}
+
+type position struct {
+	Latitude  float64
+	Longitude float64
+}
+
+func (p position) validate() error {
+	if p.Latitude < -90 || p.Latitude > 90 {
+		return fmt.Errorf("Latitude %f is outside [-90, 90]", p.Latitude)
+	}
+	if p.Longitude < -180 || p.Longitude > 180 {
+		return fmt.Errorf("Longitude %f is outside [-180, 180]", p.Longitude)
+	}
+	return nil
+}
+
+// positionFromFlags returns the position from -lat and -lon, or nil if neither was given.
+// given holds the names of the flags set on the command line, and count is the value of -n.
+func positionFromFlags(given map[string]bool, latitude, longitude float64, count int) (*position, error) {
+	if given["lat"] != given["lon"] {
+		return nil, errors.New("Both -lat and -lon must be given")
+	}
+	if !given["lat"] {
+		if given["n"] {
+			return nil, errors.New("The number of stations can only be given together with -lat and -lon")
+		}
+		return nil, nil
+	}
+
+	p := position{Latitude: latitude, Longitude: longitude}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, errors.New("The number of stations must be positive")
+	}
+	return &p, nil
+}
+
+// intToBool converts the int flags from the Oslo Bysykkel API to the booleans the GBFS spec intended
+func intToBool(value int) bool {
+	return value != 0
+}
+
+// fetch GETs the url, and retries network errors and 5xx responses with exponential backoff
+func fetch(ctx context.Context, url string) ([]byte, error) {
+
+	var body []byte
+	var err error
+
+	for attempt := 0; attempt < fetchAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(fetchBackoff(attempt)):
+			}
+		}
+
+		body, err = fetchOnce(ctx, url)
+		if err == nil || !isTransient(ctx, err) {
+			return body, err
+		}
+	}
+
+	return nil, err
+}
+
+// fetchBackoff doubles the wait for each attempt, and adds up to 50% jitter
+// so we don't hammer the API in lockstep with other clients.
+func fetchBackoff(attempt int) time.Duration {
+	backoff := fetchBackoffBase << uint(attempt-1)
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or a http date.
+// It returns 0 if the header is missing, invalid or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryAfter is how long the server asked us to wait before fetching again, if it did
+func retryAfter(err error) time.Duration {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// newClient keeps connections to the API open between updates, so we don't have to reconnect every time we poll.
+// Both feeds are fetched at the same time from the same host, hence the two idle connections per host.
+func newClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 2
+	transport.IdleConnTimeout = 5 * time.Minute
+	transport.ForceAttemptHTTP2 = true
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return true
 }
 
-func fetch(url string) ([]byte, error) {
+// fetchOnce makes a conditional request when we have a previous response for the url,
+// and reuses the previous body if the server answers 304 Not Modified.
+func fetchOnce(ctx context.Context, url string) ([]byte, error) {
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Client-Identifier", clientIdentifier)
 
+	responseCacheMutex.Lock()
+	cached, isCached := responseCache[url]
+	responseCacheMutex.Unlock()
+
+	if isCached && cached.ETag != "" {
+		req.Header.Add("If-None-Match", cached.ETag)
+	}
+	if isCached && cached.LastModified != "" {
+		req.Header.Add("If-Modified-Since", cached.LastModified)
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Http GET to %s failed with status code %d", url, resp.StatusCode)
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		return cached.Body, nil
 	}
 
-	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &httpStatusError{URL: url, StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return nil, statusErr
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != "" || lastModified != "" {
+		responseCacheMutex.Lock()
+		responseCache[url] = cachedResponse{ETag: etag, LastModified: lastModified, Body: body}
+		responseCacheMutex.Unlock()
+	}
+
 	return body, nil
 }
 
-func fetchStationInformation(informationChannel chan stationInformationResult) {
+// resolveFeeds returns the provider with the feed URLs we should use. The overrides given on the
+// command line win over the ones found by discoverFeeds, which win over the ones we know.
+// With both station feeds overridden we are most likely running against a staging server or
+// local fixtures, so we don't ask the real system for anything. Without a system_information
+// override the SystemInformationAddress is then empty.
+// If auto-discovery fails we fall back to the feed URLs we know, and also return the error.
+func resolveFeeds(ctx context.Context, p provider, accept string, overrides map[string]string) (provider, error) {
+	_, hasInformation := overrides["station_information"]
+	_, hasStatus := overrides["station_status"]
+	if hasInformation && hasStatus {
+		p.SystemInformationAddress = ""
+		return p.withFeeds(overrides), nil
+	}
 
-	body, err := fetch(stationInformationAddress)
+	feeds, err := discoverFeeds(ctx, p.DiscoveryAddress, accept)
+	return p.withFeeds(feeds).withFeeds(overrides), err
+}
+
+// discoverFeeds fetches the gbfs.json auto-discovery file, and returns the feed URLs by feed name.
+// The feeds are listed per language, and pickLanguage picks one of them from accept (the -lang flag).
+func discoverFeeds(ctx context.Context, gbfsURL, accept string) (map[string]string, error) {
+
+	body, err := fetch(ctx, gbfsURL)
 	if err != nil {
-		informationChannel <- stationInformationResult{Error: err}
-		return
+		return nil, err
+	}
+
+	var discovery gbfsDiscovery
+	err = json.Unmarshal(body, &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	languages := make([]string, 0, len(discovery.Data))
+	for lang := range discovery.Data {
+		languages = append(languages, lang)
+	}
+	if len(languages) == 0 {
+		return nil, fmt.Errorf("No feeds found in %s", gbfsURL)
+	}
+
+	lang := pickLanguage(accept, languages)
+
+	feeds := make(map[string]string)
+	for _, feed := range discovery.Data[lang].Feeds {
+		feeds[feed.Name] = feed.URL
+	}
+
+	return feeds, nil
+}
+
+// pickLanguage picks one of the available feed languages from a list of preferred languages
+// like an Accept-Language header, e.g. "en-US,en;q=0.9". The list is taken in order, and q-values are ignored.
+// Each language is matched exactly first, and then without its region. Without a match we prefer Norwegian.
+func pickLanguage(accept string, available []string) string {
+	if len(available) == 0 {
+		return ""
+	}
+
+	sorted := append([]string(nil), available...)
+	sort.Strings(sorted)
+
+	base := func(lang string) string {
+		return strings.SplitN(lang, "-", 2)[0]
+	}
+
+	for _, preferred := range strings.Split(accept, ",") {
+		preferred = strings.TrimSpace(strings.SplitN(preferred, ";", 2)[0])
+		if preferred == "" {
+			continue
+		}
+		for _, lang := range sorted {
+			if strings.EqualFold(lang, preferred) {
+				return lang
+			}
+		}
+		for _, lang := range sorted {
+			if strings.EqualFold(base(lang), base(preferred)) {
+				return lang
+			}
+		}
+	}
+
+	for _, lang := range sorted {
+		if lang == defaultLanguage {
+			return lang
+		}
+	}
+	return sorted[0]
+}
+
+// fetchSystemInformation is only called at startup, since the system information rarely changes
+func fetchSystemInformation(ctx context.Context, url string) (gbfsSystemInformation, error) {
+
+	body, err := fetch(ctx, url)
+	if err != nil {
+		return gbfsSystemInformation{}, err
+	}
+
+	var systemInformation gbfsSystemInformation
+	err = json.Unmarshal(body, &systemInformation)
+	if err != nil {
+		return gbfsSystemInformation{}, err
+	}
+
+	return systemInformation, nil
+}
+
+func fetchStationInformation(ctx context.Context, url string) (gbfsStationInformation, error) {
+
+	body, err := fetch(ctx, url)
+	if err != nil {
+		return gbfsStationInformation{}, err
 	}
 
 	var stationInformation gbfsStationInformation
 	err = json.Unmarshal(body, &stationInformation)
 	if err != nil {
-		informationChannel <- stationInformationResult{Error: err}
-		return
+		return gbfsStationInformation{}, err
 	}
 
-	informationChannel <- stationInformationResult{Information: stationInformation}
+	return stationInformation, nil
 }
 
-func fetchStationStatus(statusChannel chan stationStatusResult) {
+func fetchStationStatus(ctx context.Context, url string) (gbfsStationStatus, error) {
 
-	body, err := fetch(stationStatusAddress)
+	body, err := fetch(ctx, url)
 	if err != nil {
-		statusChannel <- stationStatusResult{Error: err}
-		return
+		return gbfsStationStatus{}, err
 	}
 
 	var stationStatus gbfsStationStatus
 	err = json.Unmarshal(body, &stationStatus)
 	if err != nil {
-		statusChannel <- stationStatusResult{Error: err}
-		return
+		return gbfsStationStatus{}, err
 	}
 
-	statusChannel <- stationStatusResult{Status: stationStatus}
+	return stationStatus, nil
 }
 
-func fetchData() ([]stationData, string, error) {
+// fetchTimeout is how long fetchData gives the fetches. Every attempt gets the whole request timeout,
+// with the longest backoff between them, but we never give up before it's time for the next update.
+func fetchTimeout(interval, requestTimeout time.Duration, attempts int) time.Duration {
+	timeout := time.Duration(attempts) * requestTimeout
+	if attempts > 1 {
+		// fetchBackoff waits at most 1.5 times base<<(attempt-1), which adds up to less than this
+		timeout += fetchBackoffBase << uint(attempts)
+	}
+	if timeout < interval {
+		return interval
+	}
+	return timeout
+}
 
-	statusChannel := make(chan stationStatusResult)
-	informationChannel := make(chan stationInformationResult)
+// fetchData returns the merged stations, and some statistics about the merge
+func fetchData(ctx context.Context, p provider) ([]stationData, fetchStats, error) {
 
-	defer close(statusChannel)
-	defer close(informationChannel)
+	var stationStatus gbfsStationStatus
+	var stationInformation gbfsStationInformation
 
-	go fetchStationStatus(statusChannel)
-	go fetchStationInformation(informationChannel)
+	timeout := fetchTimeout(time.Duration(updateInterval), time.Duration(requestTimeout), fetchAttempts)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	informationMap := make(map[string]gbfsStationInformationStation)
-	statusMap := make(map[string]gbfsStationStatusStation)
+	// The group context is cancelled as soon as one of the fetches fails,
+	// so we return the error right away instead of waiting for the other one.
+	group, groupCtx := errgroup.WithContext(ctx)
 
-	var err error
+	// With allowPartial, a failing status feed doesn't fail the group,
+	// and we show the stations without availability rather than nothing at all.
+	var statusErr error
 
-	// Wait for both fetch operations to finish before we process the data
-	for i := 0; i < 2; i++ {
-		select {
-		case statusResult := <-statusChannel:
-			if statusResult.Error != nil {
-				err = statusResult.Error
-			} else {
-				for _, station := range statusResult.Status.Data.Stations {
-					statusMap[station.StationID] = station
-				}
-			}
-		case informationResult := <-informationChannel:
-			if informationResult.Error != nil {
-				err = informationResult.Error
-			} else {
-				for _, station := range informationResult.Information.Data.Stations {
-					informationMap[station.StationID] = station
-				}
-			}
+	group.Go(func() error {
+		var err error
+		stationStatus, err = fetchStationStatus(groupCtx, p.StationStatusAddress)
+		if err != nil && allowPartial {
+			statusErr = err
+			return nil
+		}
+		return err
+	})
+
+	group.Go(func() error {
+		var err error
+		stationInformation, err = fetchStationInformation(groupCtx, p.StationInformationAddress)
+		return err
+	})
+
+	if err := group.Wait(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fetchStats{}, &fetchTimeoutError{Timeout: timeout, Err: err}
 		}
+		return nil, fetchStats{}, err
 	}
 
-	if err != nil {
-		return nil, " 🚒 Vi klarte ikke å hente data. Vent litt, så prøver vi igjen!", err
+	if statusErr != nil {
+		stationStatus = gbfsStationStatus{LastUpdated: stationInformation.LastUpdated}
+	}
+
+	// NOTE: if a station is listed more than once, the last one wins. That shouldn't happen,
+	// so we count the duplicates to let the user know that something is off.
+	stats := fetchStats{StatusFailed: statusErr != nil, MalformedStations: stationStatus.Data.Malformed}
+
+	informationMap := make(map[string]gbfsStationInformationStation)
+	for _, station := range stationInformation.Data.Stations {
+		if _, exists := informationMap[station.StationID]; exists {
+			stats.DuplicateStations++
+		}
+		informationMap[station.StationID] = station
+	}
+
+	statusMap := make(map[string]gbfsStationStatusStation)
+	for _, station := range stationStatus.Data.Stations {
+		if _, exists := statusMap[station.StationID]; exists {
+			stats.DuplicateStations++
+		}
+		statusMap[station.StationID] = station
 	}
 
 	// NOTE: we assume that having more status elements than information elements is not a problem.
 	// Missing status for a station will also not result in an error, but we will inform the user.
 
-	var message string
+	stats.TotalStations = len(informationMap)
 	stations := make([]stationData, 0, len(informationMap))
 	for stationID, information := range informationMap {
 		status, exists := statusMap[stationID]
 		if !exists {
-			message = " 🙈 Vi mangler status for noen stasjoner. Vent litt, så prøver vi igjen!"
+			stats.MissingStatus++
+			if statusErr == nil {
+				continue
+			}
+		}
+		stations = append(stations, stationData{
+			StationID:              stationID,
+			Name:                   information.Name,
+			Address:                information.Address,
+			NumberOfDocksAvailable: status.NumberOfDocksAvailable,
+			NumberOfBikesAvailable: status.NumberOfBikesAvailable,
+			NumberOfBikesDisabled:  status.NumberOfBikesDisabled,
+			NumberOfDocksDisabled:  status.NumberOfDocksDisabled,
+			Capacity:               information.Capacity,
+			Latitude:               information.Latitude,
+			Longitude:              information.Longitude,
+			IsInstalled:            intToBool(status.IsInstalled),
+			IsRenting:              intToBool(status.IsRenting),
+			IsReturning:            intToBool(status.IsReturning),
+			StatusMissing:          !exists,
+			LastReported:           unixTime(status.LastReported),
+		})
+	}
+
+	sortStations(stations, sortByName)
+
+	lastUpdated := stationStatus.LastUpdated
+	if stationInformation.LastUpdated < lastUpdated {
+		lastUpdated = stationInformation.LastUpdated
+	}
+	if !stats.StatusFailed {
+		stats.LastUpdated = time.Unix(lastUpdated, 0)
+	}
+
+	stats.FeedSkew = time.Duration(stationStatus.LastUpdated-stationInformation.LastUpdated) * time.Second
+	if stats.FeedSkew < 0 {
+		stats.FeedSkew = -stats.FeedSkew
+	}
+
+	return stations, stats, nil
+}
+
+// isTimeout tells if the fetch failed because the API was too slow. That's usually a request
+// hitting the client timeout, since fetchTimeout leaves room for every attempt to do so.
+func isTimeout(err error) bool {
+	var timeoutErr *fetchTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// fetchMessage sums up the result of fetchData for the user in a single line
+func fetchMessage(stats fetchStats, err error) string {
+	switch {
+	case isTimeout(err):
+		return " 🐢 Det tok for lang tid å hente data. Vent litt, så prøver vi igjen!"
+	case err != nil:
+		return " 🚒 Vi klarte ikke å hente data. Vent litt, så prøver vi igjen!"
+	case stats.MalformedStations > 0:
+		return fmt.Sprintf(" 🧩 Status for %d stasjoner var ugyldig, så de vises ikke. Vent litt, så prøver vi igjen!", stats.MalformedStations)
+	case stats.MissingStatus > 0:
+		return fmt.Sprintf(" 🙈 Vi mangler status for %d av %d stasjoner. Vent litt, så prøver vi igjen!", stats.MissingStatus, stats.TotalStations)
+	case stats.DuplicateStations > 0:
+		return fmt.Sprintf(" 👯 %d stasjoner er oppført mer enn én gang. Vi viser den siste av dem.", stats.DuplicateStations)
+	case stats.FeedSkew > maxFeedSkew:
+		return fmt.Sprintf(" ⏳ Status og stasjonsinformasjon er oppdatert med %d minutters mellomrom. Tallene kan være unøyaktige.", int(stats.FeedSkew.Minutes()))
+	}
+	return ""
+}
+
+func summarize(stations []stationData) stationSummary {
+	var summary stationSummary
+	for _, station := range stations {
+		summary.Stations++
+		if station.StatusMissing {
+			continue
+		}
+		summary.BikesAvailable += station.NumberOfBikesAvailable
+		summary.DocksAvailable += station.NumberOfDocksAvailable
+		summary.Capacity += station.Capacity
+		if station.NumberOfBikesAvailable == 0 {
+			summary.Empty++
+		}
+		if station.NumberOfDocksAvailable == 0 {
+			summary.Full++
+		}
+	}
+	return summary
+}
+
+// nameFolder lets searches for "skoyen" match "Skøyen", since æ, ø and å are hard to type on many keyboards
+var nameFolder = strings.NewReplacer("æ", "ae", "ø", "o", "å", "a", "é", "e")
+
+func foldName(name string) string {
+	return nameFolder.Replace(strings.ToLower(name))
+}
+
+func filterStations(stations []stationData, filter stationFilter) []stationData {
+	filtered := make([]stationData, 0, len(stations))
+	for _, station := range stations {
+		if filter.HasBikes && station.NumberOfBikesAvailable <= 0 {
+			continue
+		}
+		if filter.HasDocks && station.NumberOfDocksAvailable <= 0 {
+			continue
+		}
+		if station.NumberOfBikesAvailable < filter.MinBikes || station.NumberOfDocksAvailable < filter.MinDocks {
+			continue
+		}
+		if (filter.Empty || filter.Full) && !isProblem(station, filter) {
+			continue
+		}
+		if filter.Query != "" && !strings.Contains(foldName(station.Name), foldName(filter.Query)) {
+			continue
+		}
+		filtered = append(filtered, station)
+	}
+	return filtered
+}
+
+// unixTime is the zero time for 0, so a missing timestamp isn't taken for 1970
+func unixTime(seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// reportAge is how long before the feed was last updated the station last reported, if it has
+func reportAge(station stationData, lastUpdated time.Time) time.Duration {
+	if station.LastReported.IsZero() || station.LastReported.After(lastUpdated) {
+		return 0
+	}
+	return lastUpdated.Sub(station.LastReported)
+}
+
+func stationMap(stations []stationData) map[string]stationData {
+	byID := make(map[string]stationData, len(stations))
+	for _, station := range stations {
+		byID[station.StationID] = station
+	}
+	return byID
+}
+
+// stationsEqual tells if the two maps have the same stations, with the same data
+func stationsEqual(a, b map[string]stationData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for stationID, station := range a {
+		if other, exists := b[stationID]; !exists || other != station {
+			return false
+		}
+	}
+	return true
+}
+
+// diffStations returns the stations that are new, or have a different number of available bikes or docks,
+// sorted by station ID. Stations that have been removed are not included, and neither are the ones
+// we had no status for (with -partial), since there is nothing to compare with.
+func diffStations(old, current map[string]stationData) []stationData {
+	changed := make([]stationData, 0)
+	for stationID, station := range current {
+		previous, exists := old[stationID]
+		if exists && previous.StatusMissing {
+			continue
+		}
+		if !exists ||
+			previous.NumberOfBikesAvailable != station.NumberOfBikesAvailable ||
+			previous.NumberOfDocksAvailable != station.NumberOfDocksAvailable {
+			changed = append(changed, station)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].StationID < changed[j].StationID })
+	return changed
+}
+
+// availabilityRatio is the share of the capacity that is available, from 0 to 1.
+// Some stations report a capacity of 0, and then the ratio is unknown.
+func availabilityRatio(available, capacity int) (float64, bool) {
+	if capacity <= 0 {
+		return 0, false
+	}
+	return float64(available) / float64(capacity), true
+}
+
+// selectStations returns the stations with the given IDs in the same order,
+// and the IDs we didn't find.
+func selectStations(stations []stationData, ids []string) ([]stationData, []string) {
+	byID := stationMap(stations)
+
+	selected := make([]stationData, 0, len(ids))
+	var missing []string
+	for _, id := range ids {
+		if station, exists := byID[id]; exists {
+			selected = append(selected, station)
 		} else {
-			stations = append(stations, stationData{
-				Name:                   information.Name,
-				NumberOfDocksAvailable: status.NumberOfDocksAvailable,
-				NumberOfBikesAvailable: status.NumberOfBikesAvailable,
-			})
+			missing = append(missing, id)
+		}
+	}
+	return selected, missing
+}
+
+// isProblem tells if the station is empty or full, as asked for by the filter.
+// Stations without status may be neither, so they never are.
+func isProblem(station stationData, filter stationFilter) bool {
+	if station.StatusMissing {
+		return false
+	}
+	return (filter.Empty && station.NumberOfBikesAvailable == 0) || (filter.Full && station.NumberOfDocksAvailable == 0)
+}
+
+// sortStations sorts the stations in place. Availability is sorted descending,
+// and ties are broken by name and then station ID so the order is stable between updates.
+// Emptiest and fullest compare the share of the capacity that has bikes, and put
+// the stations where we don't know it last.
+// Names are sorted the Norwegian way, with æ, ø and å after z.
+func sortStations(stations []stationData, order sortOrder) {
+	// A collator can't be shared between goroutines, and we sort both in fetchData and in drawTable.
+	// NOTE: x/text falls back to the root order for "nb", so we use "nn", which sorts æ, ø and å the same way.
+	collator := collate.New(language.Make("nn"))
+
+	sort.Slice(stations, func(i, j int) bool {
+		a, b := stations[i], stations[j]
+		if order == sortByEmptiest || order == sortByFullest {
+			aRatio, aKnown := availabilityRatio(a.NumberOfBikesAvailable, a.Capacity)
+			bRatio, bKnown := availabilityRatio(b.NumberOfBikesAvailable, b.Capacity)
+			aKnown, bKnown = aKnown && !a.StatusMissing, bKnown && !b.StatusMissing
+			switch {
+			case aKnown != bKnown:
+				return aKnown
+			case aKnown && aRatio != bRatio && order == sortByEmptiest:
+				return aRatio < bRatio
+			case aKnown && aRatio != bRatio && order == sortByFullest:
+				return aRatio > bRatio
+			}
+		}
+		switch {
+		case order == sortByBikes && a.NumberOfBikesAvailable != b.NumberOfBikesAvailable:
+			return a.NumberOfBikesAvailable > b.NumberOfBikesAvailable
+		case order == sortByDocks && a.NumberOfDocksAvailable != b.NumberOfDocksAvailable:
+			return a.NumberOfDocksAvailable > b.NumberOfDocksAvailable
+		}
+		if byName := collator.CompareString(a.Name, b.Name); byName != 0 {
+			return byName < 0
 		}
+		return a.StationID < b.StationID
+	})
+}
+
+// distanceMeters returns the great-circle distance between two coordinates, using the haversine formula
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	deltaLatitude := toRadians(lat2 - lat1)
+	deltaLongitude := toRadians(lon2 - lon1)
+
+	a := math.Sin(deltaLatitude/2)*math.Sin(deltaLatitude/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(deltaLongitude/2)*math.Sin(deltaLongitude/2)
+
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// nearestStations returns the n stations closest to the given position, closest first
+func nearestStations(stations []stationData, from position, n int) []stationData {
+	nearest := append([]stationData(nil), stations...)
+	distance := func(station stationData) float64 {
+		return distanceMeters(from.Latitude, from.Longitude, station.Latitude, station.Longitude)
 	}
 
-	sort.Slice(stations, func(i, j int) bool { return stations[i].Name < stations[j].Name })
+	sort.SliceStable(nearest, func(i, j int) bool { return distance(nearest[i]) < distance(nearest[j]) })
 
-	return stations, message, err
+	if n < len(nearest) {
+		nearest = nearest[:n]
+	}
+	return nearest
 }
 
-func updateTable() {
+// poll calls update right away, and then every interval until the context is cancelled.
+// It also updates whenever something is received on refresh, which may be nil.
+// If update returns a positive duration, we wait at least that long before the next update,
+// but no longer than maxRetryAfterIntervals intervals, so a bogus Retry-After can't stall the UI.
+func poll(ctx context.Context, interval time.Duration, refresh <-chan struct{}, update func() time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wait := update()
+
 	for {
-		stations, message, err := fetchData()
+		if maxWait := maxRetryAfterIntervals * interval; wait > maxWait {
+			wait = maxWait
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
 
-		app.QueueUpdateDraw(func() {
-			offsetRow, offsetColumn := table.GetOffset()
-
-			if err == nil {
-				table.Clear()
-				table.SetCell(0, 0, &tview.TableCell{Text: " Stasjon ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
-				table.SetCell(0, 1, &tview.TableCell{Text: " Tilgjengelige låser ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
-				table.SetCell(0, 2, &tview.TableCell{Text: " Ledige sykler ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
-
-				for row, station := range stations {
-					bikes := fmt.Sprintf("%d", station.NumberOfBikesAvailable)
-					docks := fmt.Sprintf("%d", station.NumberOfDocksAvailable)
-					table.SetCell(row+1, 0, &tview.TableCell{Text: station.Name, Align: tview.AlignLeft, Color: tcell.ColorWhite})
-					table.SetCell(row+1, 1, &tview.TableCell{Text: bikes, Align: tview.AlignCenter, Color: tcell.ColorWhite})
-					table.SetCell(row+1, 2, &tview.TableCell{Text: docks, Align: tview.AlignCenter, Color: tcell.ColorWhite})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wait = update()
+		case <-refresh:
+			wait = update()
+		}
+	}
+}
+
+// updateTable finds the feeds and the system information before it starts polling.
+// That's done here rather than before the UI starts, so a slow API doesn't leave the terminal blank.
+func updateTable(ctx context.Context, refresh <-chan struct{}, accept string, overrides map[string]string) {
+	// Neither is worth bothering the user with: we fall back to the feed URLs we know,
+	// and to the provider's name and local time.
+	p, _ := resolveFeeds(ctx, selectedProvider, accept, overrides)
+	if p.SystemInformationAddress != "" {
+		if systemInformation, err := fetchSystemInformation(ctx, p.SystemInformationAddress); err == nil {
+			app.QueueUpdateDraw(func() {
+				applySystemInformation(systemInformation.Data)
+				drawTable()
+			})
+		}
+	}
+
+	// The stations in the -cache-file, so we only write it when something has changed
+	var saved map[string]stationData
+
+	poll(ctx, time.Duration(updateInterval), refresh, func() time.Duration {
+		stations, stats, err := fetchData(ctx, p)
+
+		// Failing to save is not worth bothering the user with, we'll try again on the next update.
+		// Stations without status are not worth saving either.
+		if err == nil && !stats.StatusFailed && cacheFile != "" {
+			if current := stationMap(stations); !stationsEqual(saved, current) {
+				if saveStations(cacheFile, savedStations{Updated: stats.LastUpdated, Stations: stations}) == nil {
+					saved = current
 				}
-				table.SetOffset(offsetRow, offsetColumn)
 			}
+		}
 
-			updateFrameTexts(message)
+		app.QueueUpdateDraw(func() {
+			applyFetchResult(stations, stats, err)
+			drawTable()
 		})
 
-		time.Sleep(updateInterval)
+		// Back off if the API tells us we're polling too often
+		return retryAfter(err)
+	})
+}
+
+// applySystemInformation shows the system's name and operator, and times in its own time zone
+func applySystemInformation(system gbfsSystemInformationData) {
+	systemData = system
+	// NOTE: LoadLocation returns UTC for an empty name, so we keep local time if the feed has no time zone
+	if location, err := time.LoadLocation(system.Timezone); system.Timezone != "" && err == nil {
+		systemLocation = location
+	}
+}
+
+// applyFetchResult updates the current state with the result of fetchData.
+// On error we keep the stations we already have, and tell the user when they were fetched.
+// Stations without status (with -partial) are only used when we have no stations at all,
+// since the last known availability is more useful than none.
+func applyFetchResult(stations []stationData, stats fetchStats, err error) {
+	message := fetchMessage(stats, err)
+
+	currentChanged = nil
+	switch {
+	case err != nil || (stats.StatusFailed && len(currentStations) > 0):
+		if !lastSuccessfulUpdate.IsZero() {
+			message += fmt.Sprintf(" Viser data hentet %s.", lastSuccessfulUpdate.In(systemLocation).Format("15:04:05"))
+		}
+	case stats.StatusFailed:
+		currentStations = stations
+	default:
+		// Highlight the stations that changed since the last update, but not everything on the first one
+		if currentStations != nil {
+			currentChanged = make(map[string]bool)
+			for _, station := range diffStations(stationMap(currentStations), stationMap(stations)) {
+				currentChanged[station.StationID] = true
+			}
+		}
+		currentStations = stations
+		currentUpdated = stats.LastUpdated
+		lastSuccessfulUpdate = time.Now()
+	}
+	currentMessage = message
+}
+
+func drawTable() {
+	offsetRow, offsetColumn := table.GetOffset()
+
+	table.Clear()
+	table.SetCell(0, 0, &tview.TableCell{Text: " Stasjon ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
+	table.SetCell(0, 1, &tview.TableCell{Text: " Tilgjengelige låser ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
+	table.SetCell(0, 2, &tview.TableCell{Text: " Ledige sykler ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
+	table.SetCell(0, 3, &tview.TableCell{Text: " Kapasitet ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
+	if userPosition != nil {
+		table.SetCell(0, 4, &tview.TableCell{Text: " Avstand ", Align: tview.AlignCenter, Color: tcell.ColorLightBlue})
+	}
+
+	stations := currentStations
+	if len(favoriteIDs) > 0 {
+		stations, _ = selectStations(stations, favoriteIDs)
+	}
+	stations = filterStations(stations, currentFilter)
+	if userPosition != nil {
+		stations = nearestStations(stations, *userPosition, nearestCount)
+	}
+	switch currentSort {
+	case sortByDistance:
+		// nearestStations has already sorted them
+	case sortAsGiven:
+		stations, _ = selectStations(stations, favoriteIDs)
+	default:
+		sortStations(stations, currentSort)
+	}
+
+	for row, station := range stations {
+		bikes := fmt.Sprintf("%d", station.NumberOfBikesAvailable)
+		docks := fmt.Sprintf("%d", station.NumberOfDocksAvailable)
+		if station.StatusMissing {
+			bikes, docks = "-", "-"
+		} else if ratio, known := availabilityRatio(station.NumberOfBikesAvailable, station.Capacity); known {
+			bikes += fmt.Sprintf(" (%.0f %%)", ratio*100)
+		}
+		capacity := fmt.Sprintf("%d", station.Capacity)
+
+		// Stations that don't rent out bikes are greyed out, so they are easy to skip
+		color := tcell.ColorWhite
+		if currentChanged[station.StationID] {
+			color = tcell.ColorYellow
+		}
+		if !station.IsRenting {
+			color = tcell.ColorGray
+		}
+
+		name := station.Name
+		if reportAge(station, currentUpdated) > maxReportAge {
+			name += " ⏳"
+		}
+
+		table.SetCell(row+1, 0, &tview.TableCell{Text: name, Align: tview.AlignLeft, Color: color})
+		table.SetCell(row+1, 1, &tview.TableCell{Text: docks, Align: tview.AlignCenter, Color: color})
+		table.SetCell(row+1, 2, &tview.TableCell{Text: bikes, Align: tview.AlignCenter, Color: color})
+		table.SetCell(row+1, 3, &tview.TableCell{Text: capacity, Align: tview.AlignCenter, Color: color})
+		if userPosition != nil {
+			distance := distanceMeters(userPosition.Latitude, userPosition.Longitude, station.Latitude, station.Longitude)
+			table.SetCell(row+1, 4, &tview.TableCell{Text: formatDistance(distance), Align: tview.AlignRight, Color: color})
+		}
+	}
+	table.SetOffset(offsetRow, offsetColumn)
+
+	updateFrameTexts(currentMessage)
+}
+
+// formatDistance rounds to the nearest meter, and shows kilometers with one decimal from 1 km
+func formatDistance(meters float64) string {
+	rounded := int(math.Round(meters))
+	if rounded < 1000 {
+		return fmt.Sprintf("%d m", rounded)
+	}
+	return strings.Replace(fmt.Sprintf("%.1f km", meters/1000), ".", ",", 1)
+}
+
+func checkbox(checked bool) string {
+	if checked {
+		return "☑"
 	}
+	return "☐"
+}
+
+// isStale tells if data last updated at the given time is too old to be trusted,
+// either because the API has stopped updating it or because we have failed to fetch it.
+func isStale(updated, now time.Time, interval time.Duration) bool {
+	return now.Sub(updated) > staleIntervals*interval
 }
 
 func updateFrameTexts(message string) {
+	updated := "-"
+	if !currentUpdated.IsZero() {
+		updated = currentUpdated.In(systemLocation).Format("02.01.2006 15:04:05")
+		if isStale(currentUpdated, time.Now(), time.Duration(updateInterval)) {
+			updated += " ⚠ dataene kan være utdaterte"
+		}
+	}
+
+	summary := summarize(currentStations)
+
+	name := selectedProvider.Name
+	if systemData.Name != "" {
+		name = systemData.Name
+	}
+
+	filters := fmt.Sprintf("%s ledige sykler ('b')  %s ledige låser ('d')  %s tomme ('e')  %s fulle ('f')",
+		checkbox(currentFilter.HasBikes), checkbox(currentFilter.HasDocks), checkbox(currentFilter.Empty), checkbox(currentFilter.Full))
+	if currentFilter.MinBikes > 0 {
+		filters += fmt.Sprintf("  minst %d sykler", currentFilter.MinBikes)
+	}
+	if currentFilter.MinDocks > 0 {
+		filters += fmt.Sprintf("  minst %d låser", currentFilter.MinDocks)
+	}
+	if len(favoriteIDs) > 0 {
+		filters += fmt.Sprintf("  %d favoritter", len(favoriteIDs))
+		if _, missing := selectStations(currentStations, favoriteIDs); len(currentStations) > 0 && len(missing) > 0 {
+			filters += fmt.Sprintf(" (fant ikke %s)", strings.Join(missing, ", "))
+		}
+	}
+
 	frame.Clear()
-	frame.AddText(" 🚴 Oslo BySykkel 🚴", true, tview.AlignLeft, tcell.ColorLightBlue).
+	frame.AddText(fmt.Sprintf(" 🚴 %s 🚴", name), true, tview.AlignLeft, tcell.ColorLightBlue).
 		AddText("", true, tview.AlignLeft, tcell.ColorLightBlue).
-		AddText(" Hei!👋\t Du kan bla i listen med ⍐ og ⍗. Avslutt med 'q'.", true, tview.AlignLeft, tcell.ColorLightBlue).
+		AddText(" Hei!👋\t Du kan bla i listen med ⍐ og ⍗, og søke med '/'. Oppdater med 'r', og avslutt med 'q'.", true, tview.AlignLeft, tcell.ColorLightBlue).
+		AddText(fmt.Sprintf(" Filtre:\t %s", filters), true, tview.AlignLeft, tcell.ColorLightBlue).
+		AddText(fmt.Sprintf(" Oppdatert:\t %s", updated), true, tview.AlignLeft, tcell.ColorLightBlue).
+		AddText(fmt.Sprintf(" Totalt:\t %d stasjoner med plass til %d sykler, %d ledige sykler og %d ledige låser. %d tomme og %d fulle stasjoner.",
+			summary.Stations, summary.Capacity, summary.BikesAvailable, summary.DocksAvailable, summary.Empty, summary.Full), true, tview.AlignLeft, tcell.ColorLightBlue).
+		AddText(fmt.Sprintf(" Sortering:\t %s ('s')", sortOrderNames[currentSort]), true, tview.AlignLeft, tcell.ColorLightBlue).
 		AddText(message, false, tview.AlignLeft, tcell.ColorLightBlue)
+
+	if systemData.Operator != "" {
+		frame.AddText(contactLine(systemData), false, tview.AlignLeft, tcell.ColorGray)
+	}
+}
+
+// contactLine tells who operates the system, and how to reach them if the feed says so
+func contactLine(system gbfsSystemInformationData) string {
+	line := fmt.Sprintf(" Drives av %s\t", system.Operator)
+	if system.PhoneNumber != "" {
+		line += fmt.Sprintf(" ☎ %s ", system.PhoneNumber)
+	}
+	if system.Email != "" {
+		line += fmt.Sprintf(" ✉ %s", system.Email)
+	}
+	return strings.TrimRight(line, " ")
+}
+
+// stationIDs is a flag.Value for a comma-separated list of station IDs
+type stationIDs []string
+
+func (ids *stationIDs) String() string {
+	return strings.Join(*ids, ",")
+}
+
+func (ids *stationIDs) Set(value string) error {
+	*ids = nil
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			*ids = append(*ids, id)
+		}
+	}
+	if len(*ids) == 0 {
+		return fmt.Errorf("No station IDs in %q", value)
+	}
+	return nil
+}
+
+// writeProviders lists the bike share systems we know, for -providers
+func writeProviders(w io.Writer) error {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", name, providers[name].Name, providers[name].DiscoveryAddress)
+	}
+	return writer.Flush()
+}
+
+// versionString describes the build, with defaults for builds without -ldflags
+func versionString() string {
+	orDefault := func(value, fallback string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	}
+	return fmt.Sprintf("oslobysykkel %s (commit %s, built %s)", orDefault(version, "dev"), orDefault(commit, "unknown"), orDefault(buildTime, "unknown"))
+}
+
+// positiveDuration is a flag.Value for durations that must be greater than zero
+type positiveDuration time.Duration
+
+func (d *positiveDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *positiveDuration) Set(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("The duration %s must be positive", duration)
+	}
+	*d = positiveDuration(duration)
+	return nil
+}
+
+// writeCSV writes a header row, followed by one row per station
+func writeCSV(w io.Writer, stations []stationData) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{"station_id", "name", "num_bikes_available", "num_docks_available", "bikes_ratio", "docks_ratio"}); err != nil {
+		return err
+	}
+
+	for _, station := range stations {
+		record := []string{
+			station.StationID,
+			station.Name,
+			strconv.Itoa(station.NumberOfBikesAvailable),
+			strconv.Itoa(station.NumberOfDocksAvailable),
+			"",
+			"",
+		}
+		// Leave the availability empty rather than claim the station is empty
+		if station.StatusMissing {
+			record[2], record[3] = "", ""
+		} else if bikesRatio, known := availabilityRatio(station.NumberOfBikesAvailable, station.Capacity); known {
+			docksRatio, _ := availabilityRatio(station.NumberOfDocksAvailable, station.Capacity)
+			record[4], record[5] = strconv.FormatFloat(bikesRatio, 'f', 2, 64), strconv.FormatFloat(docksRatio, 'f', 2, 64)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// savedStations is what we keep in the -cache-file between runs
+type savedStations struct {
+	Updated  time.Time
+	Stations []stationData
+}
+
+// saveStations writes to a temporary file that is renamed into place,
+// so a crash while writing never leaves a half-written file behind.
+func saveStations(path string, saved savedStations) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := json.NewEncoder(file).Encode(saved); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func loadStations(path string) (savedStations, error) {
+	var saved savedStations
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return saved, err
+	}
+
+	err = json.Unmarshal(data, &saved)
+	return saved, err
+}
+
+// envOrDefault returns the value of the environment variable, or the default if it is unset or empty
+func envOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
 }
 
 func main() {
-	client = &http.Client{Timeout: requestTimeout}
+	providerName := flag.String("provider", defaultProvider, "the bike share system to show: oslo, bergen or trondheim")
+	flag.StringVar(&clientIdentifier, "client-id", envOrDefault("CLIENT_IDENTIFIER", defaultClientIdentifier), "the Client-Identifier sent to the Oslo Bysykkel API (or set CLIENT_IDENTIFIER)")
+	flag.Var(&updateInterval, "update-interval", "how often to fetch new data, e.g. 30s")
+	flag.Var(&requestTimeout, "request-timeout", "timeout for each request to the Oslo Bysykkel API, e.g. 5s")
+	latitude := flag.Float64("lat", 0, "your latitude, to only show the stations closest to you")
+	longitude := flag.Float64("lon", 0, "your longitude, to only show the stations closest to you")
+	flag.IntVar(&nearestCount, "n", defaultNearestCount, "the number of stations to show when -lat and -lon are given")
+	flag.IntVar(&currentFilter.MinBikes, "min-bikes", 0, "only show stations with at least this many available bikes")
+	flag.IntVar(&currentFilter.MinDocks, "min-docks", 0, "only show stations with at least this many available docks")
+	flag.BoolVar(&allowPartial, "partial", false, "show the stations without availability if only the station status can't be fetched")
+	flag.Var(&favoriteIDs, "ids", "only show these stations, e.g. 627,623")
+	systemURL := flag.String("system-url", "", "use this system_information feed instead of the provider's")
+	informationURL := flag.String("information-url", "", "use this station_information feed instead of the provider's")
+	statusURL := flag.String("status-url", "", "use this station_status feed instead of the provider's")
+	languages := flag.String("lang", "", "the preferred languages for station names, if the system has more than one, e.g. en or en,nb")
+	flag.StringVar(&cacheFile, "cache-file", "", "save the stations to this file, and show them right away on the next start")
+	exportCSV := flag.Bool("csv", false, "write the stations as CSV to stdout and exit, instead of showing the table")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	listProviders := flag.Bool("providers", false, "list the bike share systems you can choose with -provider, and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if *listProviders {
+		if err := writeProviders(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	p, exists := providers[*providerName]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "Unknown provider %q\n", *providerName)
+		os.Exit(2)
+	}
+	selectedProvider = p
+
+	if currentFilter.MinBikes < 0 || currentFilter.MinDocks < 0 {
+		fmt.Fprintln(os.Stderr, "The minimum number of bikes and docks can't be negative")
+		os.Exit(2)
+	}
+
+	// Oslo Bysykkel asks every client to identify itself, see https://oslobysykkel.no/apne-data/sanntid
+	if clientIdentifier == defaultClientIdentifier {
+		log.Printf("Warning: using the default Client-Identifier %q, please set -client-id or CLIENT_IDENTIFIER", clientIdentifier)
+	}
+
+	// Show the stations in the order the user gave them, unless we sort by distance below
+	if len(favoriteIDs) > 0 {
+		currentSort = sortAsGiven
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	if userPosition, err = positionFromFlags(given, *latitude, *longitude, nearestCount); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if userPosition != nil {
+		currentSort = sortByDistance
+	}
+
+	client = newClient(time.Duration(requestTimeout))
+
+	overrides := make(map[string]string)
+	for name, url := range map[string]string{"system_information": *systemURL, "station_information": *informationURL, "station_status": *statusURL} {
+		if url != "" {
+			overrides[name] = url
+		}
+	}
+
+	if *exportCSV {
+		p, err := resolveFeeds(context.Background(), selectedProvider, *languages, overrides)
+		if err != nil {
+			log.Printf("Warning: GBFS auto-discovery failed, using the known feed URLs: %s", err)
+		}
+		stations, _, err := fetchData(context.Background(), p)
+		if err == nil && len(favoriteIDs) > 0 {
+			stations, _ = selectStations(stations, favoriteIDs)
+		}
+		if err == nil {
+			err = writeCSV(os.Stdout, filterStations(stations, currentFilter))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Show the stations we saved last time until the first fetch is done
+	if cacheFile != "" {
+		if saved, err := loadStations(cacheFile); err == nil {
+			currentStations, currentUpdated = saved.Stations, saved.Updated
+		} else if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read the saved stations from %s: %s", cacheFile, err)
+		}
+	}
 
 	table = tview.NewTable().
 		SetFixed(1, 0).
@@ -270,18 +1595,82 @@ func main() {
 	frame = tview.NewFrame(table).
 		SetBorders(1, 1, 1, 1, 2, 2)
 
-	updateFrameTexts("📦 henter data ...")
+	currentMessage = "📦 henter data ..."
+	drawTable()
+
+	// Enter keeps the search and goes back to the list, Escape clears it
+	search = tview.NewInputField().
+		SetLabel(" Søk: ").
+		SetChangedFunc(func(text string) {
+			currentFilter.Query = text
+			drawTable()
+		}).
+		SetDoneFunc(func(key tcell.Key) {
+			if key == tcell.KeyEscape {
+				search.SetText("")
+			}
+			app.SetFocus(table)
+		})
+
+	layout := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(frame, 0, 1, true).
+		AddItem(search, 1, 0, false)
+
+	// 'r' asks for an update right away. One pending refresh is enough,
+	// so the buffer also keeps repeated key presses from piling up.
+	refresh := make(chan struct{}, 1)
 
 	app = tview.NewApplication().
-		SetRoot(frame, true).
+		SetRoot(layout, true).
 		SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-			if event.Rune() == 'q' {
+			// Let the search field have all the keys while the user is typing
+			if app.GetFocus() == search {
+				return event
+			}
+
+			switch event.Rune() {
+			case '/':
+				app.SetFocus(search)
+				return nil
+			case 'q':
 				app.Stop()
+			case 'r':
+				select {
+				case refresh <- struct{}{}:
+				default:
+				}
+			case 'b':
+				currentFilter.HasBikes = !currentFilter.HasBikes
+				drawTable()
+			case 'd':
+				currentFilter.HasDocks = !currentFilter.HasDocks
+				drawTable()
+			case 'e':
+				currentFilter.Empty = !currentFilter.Empty
+				drawTable()
+			case 'f':
+				currentFilter.Full = !currentFilter.Full
+				drawTable()
+			case 's':
+				currentSort = nextSortOrder(currentSort, userPosition != nil, len(favoriteIDs) > 0)
+				drawTable()
 			}
 			return event
 		})
 
-	go updateTable()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop the UI on SIGINT/SIGTERM as well, so the terminal is restored before we exit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		app.Stop()
+	}()
+
+	go updateTable(ctx, refresh, *languages, overrides)
 
 	if err := app.Run(); err != nil {
 		panic(err)
@@ -2,10 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testFetchCase struct {
@@ -16,6 +25,29 @@ type testFetchCase struct {
 	ExpectedBody           []byte
 }
 
+type testFetchRetryCase struct {
+	ResponseStatusCodes []int
+	ExpectedRequests    int
+	ExpectError         bool
+}
+
+type testDiscoverFeedsCase struct {
+	testFetchCase
+	Accept        string
+	ExpectedFeeds map[string]string
+}
+
+type testPickLanguageCase struct {
+	Accept    string
+	Available []string
+	Expected  string
+}
+
+type testFetchSystemInformationCase struct {
+	testFetchCase
+	ExpectedInformation gbfsSystemInformation
+}
+
 type testFetchStationInformationCase struct {
 	testFetchCase
 	ExpectedInformation gbfsStationInformation
@@ -30,6 +62,107 @@ type testFetchDataCase struct {
 	FetchStatus      testFetchCase
 	FetchInformation testFetchCase
 	ExpectedData     []stationData
+	ExpectedStats    fetchStats
+}
+
+type testFetchMessageCase struct {
+	Stats           fetchStats
+	Error           error
+	ExpectedMessage string
+}
+
+type testFilterStationsCase struct {
+	Filter           stationFilter
+	ExpectedStations []stationData
+}
+
+type testSortStationsCase struct {
+	Order         sortOrder
+	ExpectedOrder []string
+}
+
+type testDistanceMetersCase struct {
+	From     position
+	To       position
+	Expected float64
+}
+
+type testPositionValidateCase struct {
+	Position    position
+	ExpectError bool
+}
+
+type testPositiveDurationCase struct {
+	Value       string
+	Expected    time.Duration
+	ExpectError bool
+}
+
+type testFoldNameCase struct {
+	Name     string
+	Query    string
+	Expected bool
+}
+
+type testFormatDistanceCase struct {
+	Meters   float64
+	Expected string
+}
+
+type testParseRetryAfterCase struct {
+	Value    string
+	Expected time.Duration
+}
+
+type testStationIDsCase struct {
+	Value       string
+	Expected    stationIDs
+	ExpectError bool
+}
+
+type testContactLineCase struct {
+	System   gbfsSystemInformationData
+	Expected string
+}
+
+type testResolveFeedsCase struct {
+	DiscoveryStatusCode        int
+	Overrides                  map[string]string
+	ExpectedSystemAddress      string
+	ExpectedInformationAddress string
+	ExpectedStatusAddress      string
+	ExpectDiscovery            bool
+}
+
+type testFetchTimeoutCase struct {
+	Interval       time.Duration
+	RequestTimeout time.Duration
+	Attempts       int
+	Expected       time.Duration
+}
+
+type testIsTransientCase struct {
+	Error    error
+	Expected bool
+}
+
+type testPositionFromFlagsCase struct {
+	Given            map[string]bool
+	Count            int
+	ExpectedPosition *position
+	ExpectError      bool
+}
+
+type testNextSortOrderCase struct {
+	Current     sortOrder
+	HasPosition bool
+	HasIDs      bool
+	Expected    sortOrder
+}
+
+type testIntToBoolCase struct {
+	Value    int
+	Expected bool
 }
 
 // NOTE: rather than spinning up a httptest.Server we test by replacing the
@@ -43,6 +176,20 @@ func (ct CustomTransport) RoundTrip(request *http.Request) (*http.Response, erro
 	return ct(request), nil
 }
 
+// HangingTransport never answers, and fails like http.Transport when the request is cancelled
+type HangingTransport struct{}
+
+func (HangingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	<-request.Context().Done()
+	return nil, request.Context().Err()
+}
+
+// Retries are tested separately in TestFetchRetry, everything else only gets one attempt
+func TestMain(m *testing.M) {
+	fetchAttempts = 1
+	os.Exit(m.Run())
+}
+
 func verifyFetchRequest(t *testing.T, expectedURL string, request *http.Request) {
 
 	const expectedHTTPMethod = http.MethodGet
@@ -121,7 +268,7 @@ func TestFetchBase(t *testing.T) {
 			}
 		})}
 
-		body, err := fetch("https://hostname.com/path/to")
+		body, err := fetch(context.Background(), "https://hostname.com/path/to")
 
 		if !testCase.ExpectError && err != nil {
 			t.Errorf("We got an unexpected error: %s", err.Error())
@@ -137,465 +284,2700 @@ func TestFetchBase(t *testing.T) {
 	}
 }
 
-func TestFetchStationInformation(t *testing.T) {
+func TestNewClient(t *testing.T) {
 
-	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
-	if err != nil {
-		t.Errorf("Failed to read the test data file: %s", err.Error())
+	tunedClient := newClient(5 * time.Second)
+
+	if tunedClient.Timeout != 5*time.Second {
+		t.Errorf("The client timeout %s is different from the expected %s", tunedClient.Timeout, 5*time.Second)
 	}
 
-	testCases := []testFetchStationInformationCase{
-		{
-			// Happy path
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationInformationResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            false,
-			},
-			ExpectedInformation: gbfsStationInformation{
-				LastUpdated: 1553592653,
-				Data: gbfsStationInformationData{
-					Stations: []gbfsStationInformationStation{
-						{
-							StationID: "627",
-							Name:      "Skøyen Stasjon",
-							Address:   "Skøyen Stasjon",
-							Latitude:  59.9226729,
-							Longitude: 10.6788129,
-							Capacity:  20,
-						},
-						{
-							StationID: "623",
-							Name:      "7 Juni Plassen",
-							Address:   "7 Juni Plassen",
-							Latitude:  59.9150596,
-							Longitude: 10.7312715,
-							Capacity:  15,
-						},
-						{
-							StationID: "610",
-							Name:      "Sotahjørnet",
-							Address:   "Sotahjørnet",
-							Latitude:  59.9099822,
-							Longitude: 10.7914482,
-							Capacity:  20,
-						},
-					},
-				},
-			},
-		},
-		{
-			// Empty response data
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           ``,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedInformation: gbfsStationInformation{},
-		},
-		{
-			// Garbled response data
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           `{$#`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedInformation: gbfsStationInformation{},
-		},
-		{
-			// Internal Server Error
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusInternalServerError,
-				ResponseBody:           `Internal Server Error`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedInformation: gbfsStationInformation{},
-		},
+	transport, ok := tunedClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("The client transport is a %T, expected a *http.Transport", tunedClient.Transport)
 	}
 
-	for _, testCase := range testCases {
+	if transport.MaxIdleConnsPerHost != 2 || transport.IdleConnTimeout != 5*time.Minute || !transport.ForceAttemptHTTP2 {
+		t.Errorf("The transport is not tuned: %d idle connections per host, %s idle timeout, HTTP/2 %t",
+			transport.MaxIdleConnsPerHost, transport.IdleConnTimeout, transport.ForceAttemptHTTP2)
+	}
 
-		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
-			verifyFetchRequest(t, testCase.ExpectedRequestAddress, request)
-			return &http.Response{
-				StatusCode: testCase.ResponseStatusCode,
-				Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.ResponseBody)),
-				Header:     make(http.Header),
-			}
-		})}
+	// The proxy settings from the default transport are kept
+	if transport.Proxy == nil {
+		t.Errorf("The transport does not use the proxy from the environment")
+	}
+}
+
+func TestFetchNotModified(t *testing.T) {
 
-		informationChannel := make(chan stationInformationResult)
-		defer close(informationChannel)
+	defer func() { responseCache = make(map[string]cachedResponse) }()
 
-		go fetchStationInformation(informationChannel)
+	const body = `{"last_updated": 1540219230}`
+	requests := 0
 
-		informationResult := <-informationChannel
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		requests++
 
-		if !testCase.ExpectError && informationResult.Error != nil {
-			t.Errorf("We got an unexpected error: %s", informationResult.Error.Error())
+		// The first request is unconditional, the second one must use the validators we got
+		if requests == 1 {
+			if request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Modified-Since") != "" {
+				t.Errorf("The first request should not be conditional")
+			}
+			header := make(http.Header)
+			header.Set("ETag", `"abc"`)
+			header.Set("Last-Modified", "Mon, 22 Oct 2018 14:40:30 GMT")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+				Header:     header,
+			}
 		}
 
-		if testCase.ExpectError && informationResult.Error == nil {
-			t.Errorf("We did not receive the expected error")
+		if request.Header.Get("If-None-Match") != `"abc"` {
+			t.Errorf("The request If-None-Match `%s` is different from the expected `\"abc\"`", request.Header.Get("If-None-Match"))
+		}
+		if request.Header.Get("If-Modified-Since") != "Mon, 22 Oct 2018 14:40:30 GMT" {
+			t.Errorf("The request If-Modified-Since `%s` is different from the expected Last-Modified", request.Header.Get("If-Modified-Since"))
+		}
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			Header:     make(http.Header),
 		}
+	})}
 
-		if !reflect.DeepEqual(informationResult.Information, testCase.ExpectedInformation) {
-			t.Errorf("The received station information is different from the expected station information")
+	for i := 0; i < 2; i++ {
+		received, err := fetch(context.Background(), "https://hostname.com/path/to")
+
+		if err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
 		}
-	}
-}
 
-func TestFetchStationStatus(t *testing.T) {
-	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status.json")
-	if err != nil {
-		t.Errorf("Failed to read the test data file: %s", err.Error())
+		if string(received) != body {
+			t.Errorf("The received body `%s` is different from the expected body `%s`", received, body)
+		}
 	}
 
-	testCases := []testFetchStationStatusCase{
-		{
-			// Happy path
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationStatusResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            false,
-			},
-			ExpectedStatus: gbfsStationStatus{
-				LastUpdated: 1540219230,
-				Data: gbfsStationStatusData{
-					Stations: []gbfsStationStatusStation{
-						{
-							StationID:              "627",
-							NumberOfBikesAvailable: 7,
-							NumberOfDocksAvailable: 5,
-							IsInstalled:            1,
-							IsRenting:              1,
-							IsReturning:            1,
-							LastReported:           1540219230,
-						},
-						{
-							StationID:              "623",
-							NumberOfBikesAvailable: 4,
-							NumberOfDocksAvailable: 8,
-							IsInstalled:            1,
-							IsRenting:              1,
-							IsReturning:            1,
-							LastReported:           1540219230,
-						},
-						{
-							StationID:              "610",
-							NumberOfBikesAvailable: 4,
-							NumberOfDocksAvailable: 9,
-							IsInstalled:            1,
-							IsRenting:              1,
-							IsReturning:            1,
-							LastReported:           1540219230,
-						},
-					},
-				},
-			},
-		},
-		{
-			// Empty response data
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           ``,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			ExpectedStatus: gbfsStationStatus{},
-		},
-		{
-			// Garbled response data
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           `{$#`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			ExpectedStatus: gbfsStationStatus{},
-		},
-		{
-			// Internal Server Error
-			testFetchCase: testFetchCase{
-				ResponseStatusCode:     http.StatusInternalServerError,
-				ResponseBody:           `Internal Server Error`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			ExpectedStatus: gbfsStationStatus{},
-		},
+	if requests != 2 {
+		t.Errorf("We made %d requests, expected 2", requests)
 	}
+}
 
-	for _, testCase := range testCases {
-
-		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
-			verifyFetchRequest(t, testCase.ExpectedRequestAddress, request)
-			return &http.Response{
-				StatusCode: testCase.ResponseStatusCode,
-				Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.ResponseBody)),
-				Header:     make(http.Header),
-			}
-		})}
+func TestFetchClientIdentifierFromEnvironment(t *testing.T) {
 
-		statusChannel := make(chan stationStatusResult)
-		defer close(statusChannel)
+	const expectedClientIdentifier = "acme-bysykkelapp"
 
-		go fetchStationStatus(statusChannel)
+	os.Setenv("CLIENT_IDENTIFIER", expectedClientIdentifier)
+	defer os.Unsetenv("CLIENT_IDENTIFIER")
 
-		statusResult := <-statusChannel
+	clientIdentifier = envOrDefault("CLIENT_IDENTIFIER", defaultClientIdentifier)
+	defer func() { clientIdentifier = defaultClientIdentifier }()
 
-		if !testCase.ExpectError && statusResult.Error != nil {
-			t.Errorf("We got an unexpected error: %s", statusResult.Error.Error())
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		if request.Header.Get("Client-Identifier") != expectedClientIdentifier {
+			t.Errorf("The request Client-Identifier `%s` is different from the expected `%s`", request.Header.Get("Client-Identifier"), expectedClientIdentifier)
 		}
-
-		if testCase.ExpectError && statusResult.Error == nil {
-			t.Errorf("We did not receive the expected error")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
 		}
+	})}
 
-		if !reflect.DeepEqual(statusResult.Status, testCase.ExpectedStatus) {
-			t.Errorf("The received station status is different from the expected station status")
-		}
+	if _, err := fetch(context.Background(), "https://hostname.com/path/to"); err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
 	}
 }
 
-func TestFetchData(t *testing.T) {
+func TestWriteCSV(t *testing.T) {
 
-	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
-	if err != nil {
-		t.Errorf("Failed to read the test data file: %s", err.Error())
+	stations := []stationData{
+		{StationID: "623", Name: "7 Juni Plassen", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 8},
+		{StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7, NumberOfDocksAvailable: 5},
+		{StationID: "610", Name: "Sotahjørnet, \"hjørnet\"", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 9, Capacity: 13},
+		{StationID: "611", Name: "Uten status", Capacity: 20, StatusMissing: true},
 	}
 
-	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status.json")
+	var buffer bytes.Buffer
+	if err := writeCSV(&buffer, stations); err != nil {
+		t.Fatalf("We got an unexpected error: %s", err.Error())
+	}
+
+	records, err := csv.NewReader(&buffer).ReadAll()
 	if err != nil {
-		t.Errorf("Failed to read the test data file: %s", err.Error())
+		t.Fatalf("Failed to parse the written CSV: %s", err.Error())
 	}
 
-	testCases := []testFetchDataCase{
-		{
-			// Happy path
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationStatusResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+	if len(records) != len(stations)+1 {
+		t.Fatalf("The CSV has %d rows, expected a header and %d stations", len(records), len(stations))
+	}
+
+	expectedHeader := []string{"station_id", "name", "num_bikes_available", "num_docks_available", "bikes_ratio", "docks_ratio"}
+	if !reflect.DeepEqual(records[0], expectedHeader) {
+		t.Errorf("The CSV header %v is different from the expected %v", records[0], expectedHeader)
+	}
+
+	expectedRow := []string{"610", "Sotahjørnet, \"hjørnet\"", "4", "9", "0.31", "0.69"}
+	if !reflect.DeepEqual(records[3], expectedRow) {
+		t.Errorf("The CSV row %v is different from the expected %v", records[3], expectedRow)
+	}
+
+	// The availability is left empty for stations without status
+	expectedRow = []string{"611", "Uten status", "", "", "", ""}
+	if !reflect.DeepEqual(records[4], expectedRow) {
+		t.Errorf("The CSV row %v is different from the expected %v", records[4], expectedRow)
+	}
+
+	// The ratios are left empty when the capacity is unknown
+	expectedRow = []string{"623", "7 Juni Plassen", "4", "8", "", ""}
+	if !reflect.DeepEqual(records[1], expectedRow) {
+		t.Errorf("The CSV row %v is different from the expected %v", records[1], expectedRow)
+	}
+}
+
+func TestSaveAndLoadStations(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "oslobysykkel")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stations.json")
+	saved := savedStations{
+		Updated:  time.Unix(1540219230, 0),
+		Stations: []stationData{{StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7, NumberOfDocksAvailable: 5}},
+	}
+
+	if err := saveStations(path, saved); err != nil {
+		t.Fatalf("We got an unexpected error: %s", err.Error())
+	}
+
+	loaded, err := loadStations(path)
+	if err != nil {
+		t.Fatalf("We got an unexpected error: %s", err.Error())
+	}
+
+	if !loaded.Updated.Equal(saved.Updated) || !reflect.DeepEqual(loaded.Stations, saved.Stations) {
+		t.Errorf("The loaded stations %+v are different from the saved stations %+v", loaded, saved)
+	}
+
+	// Only the saved file is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("There are %d files in the directory, expected only the saved file", len(files))
+	}
+
+	// A missing file is expected on the first run
+	if _, err := loadStations(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("We did not receive the expected not exist error, got %v", err)
+	}
+
+	// A corrupt file is an error, but not a missing file
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte(`{"Stations": [`), 0644); err != nil {
+		t.Fatalf("Failed to write the corrupt file: %s", err.Error())
+	}
+	if _, err := loadStations(corrupt); err == nil || os.IsNotExist(err) {
+		t.Errorf("We did not receive the expected error, got %v", err)
+	}
+}
+
+func TestEnvOrDefault(t *testing.T) {
+
+	os.Unsetenv("OSLOBYSYKKEL_TEST")
+	if value := envOrDefault("OSLOBYSYKKEL_TEST", "default"); value != "default" {
+		t.Errorf("envOrDefault returned `%s` for an unset variable, expected `default`", value)
+	}
+
+	os.Setenv("OSLOBYSYKKEL_TEST", "set")
+	defer os.Unsetenv("OSLOBYSYKKEL_TEST")
+	if value := envOrDefault("OSLOBYSYKKEL_TEST", "default"); value != "set" {
+		t.Errorf("envOrDefault returned `%s` for a set variable, expected `set`", value)
+	}
+}
+
+func TestFetchRetry(t *testing.T) {
+
+	defer func(attempts int, backoffBase time.Duration) {
+		fetchAttempts, fetchBackoffBase = attempts, backoffBase
+	}(fetchAttempts, fetchBackoffBase)
+
+	fetchAttempts = 3
+	fetchBackoffBase = time.Millisecond
+
+	testCases := []testFetchRetryCase{
+		{
+			// Two server errors, then success
+			ResponseStatusCodes: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+			ExpectedRequests:    3,
+			ExpectError:         false,
+		},
+		{
+			// Server errors on every attempt
+			ResponseStatusCodes: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			ExpectedRequests:    3,
+			ExpectError:         true,
+		},
+		{
+			// Client errors are not retried
+			ResponseStatusCodes: []int{http.StatusNotFound},
+			ExpectedRequests:    1,
+			ExpectError:         true,
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		requests := 0
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			verifyFetchRequest(t, "https://hostname.com/path/to", request)
+			statusCode := testCase.ResponseStatusCodes[requests]
+			requests++
+			return &http.Response{
+				StatusCode: statusCode,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		_, err := fetch(context.Background(), "https://hostname.com/path/to")
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error")
+		}
+
+		if requests != testCase.ExpectedRequests {
+			t.Errorf("We made %d requests, expected %d", requests, testCase.ExpectedRequests)
+		}
+	}
+}
+
+func TestFetchRetryAfter(t *testing.T) {
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		header := make(http.Header)
+		header.Set("Retry-After", "120")
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			Header:     header,
+		}
+	})}
+
+	_, err := fetch(context.Background(), "https://hostname.com/path/to")
+
+	if err == nil {
+		t.Fatalf("We did not receive the expected error")
+	}
+
+	if wait := retryAfter(err); wait != 2*time.Minute {
+		t.Errorf("We were asked to wait %s, expected %s", wait, 2*time.Minute)
+	}
+
+	// The wait is still found when the error has been wrapped
+	if wait := retryAfter(&fetchTimeoutError{Timeout: time.Second, Err: err}); wait != 2*time.Minute {
+		t.Errorf("We were asked to wait %s by the wrapped error, expected %s", wait, 2*time.Minute)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+
+	testCases := []testIsTransientCase{
+		{
+			// Network errors may go away
+			Error:    errors.New("connection reset by peer"),
+			Expected: true,
+		},
+		{
+			// So may server errors
+			Error:    &httpStatusError{URL: "https://hostname.com/path/to", StatusCode: http.StatusBadGateway},
+			Expected: true,
+		},
+		{
+			// Client errors won't
+			Error:    &httpStatusError{URL: "https://hostname.com/path/to", StatusCode: http.StatusNotFound},
+			Expected: false,
+		},
+		{
+			// Not even when they are wrapped
+			Error:    &fetchTimeoutError{Timeout: time.Second, Err: &httpStatusError{URL: "https://hostname.com/path/to", StatusCode: http.StatusNotFound}},
+			Expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if transient := isTransient(context.Background(), testCase.Error); transient != testCase.Expected {
+			t.Errorf("The error %v is transient: %t, expected %t", testCase.Error, transient, testCase.Expected)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	now := time.Date(2019, time.March, 26, 10, 0, 0, 0, time.UTC)
+
+	testCases := []testParseRetryAfterCase{
+		{
+			// Seconds
+			Value:    "30",
+			Expected: 30 * time.Second,
+		},
+		{
+			// A http date
+			Value:    "Tue, 26 Mar 2019 10:01:30 GMT",
+			Expected: 90 * time.Second,
+		},
+		{
+			// A http date in the past
+			Value:    "Tue, 26 Mar 2019 09:59:00 GMT",
+			Expected: 0,
+		},
+		{
+			// Negative seconds
+			Value:    "-5",
+			Expected: 0,
+		},
+		{
+			// Missing
+			Value:    "",
+			Expected: 0,
+		},
+		{
+			// Garbage
+			Value:    "soon",
+			Expected: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if wait := parseRetryAfter(testCase.Value, now); wait != testCase.Expected {
+			t.Errorf("Retry-After `%s` gave %s, expected %s", testCase.Value, wait, testCase.Expected)
+		}
+	}
+}
+
+func TestDiscoverFeeds(t *testing.T) {
+
+	discoveryResponse, err := ioutil.ReadFile("main_testdata/gbfs.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	testCases := []testDiscoverFeedsCase{
+		{
+			// Happy path
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(discoveryResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
 				ExpectError:            false,
 			},
-			FetchInformation: testFetchCase{
+			ExpectedFeeds: map[string]string{
+				"system_information":  "https://gbfs.urbansharing.com/oslobysykkel.no/system_information.json",
+				"station_information": "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				"station_status":      "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+			},
+		},
+		{
+			// Norwegian is preferred over other languages
+			testFetchCase: testFetchCase{
 				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationInformationResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ResponseBody:           `{"data": {"en": {"feeds": [{"name": "station_status", "url": "https://en"}]}, "nb": {"feeds": [{"name": "station_status", "url": "https://nb"}]}}}`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
 				ExpectError:            false,
 			},
-			ExpectedData: []stationData{
-				{
-					Name:                   "7 Juni Plassen",
-					NumberOfBikesAvailable: 4,
-					NumberOfDocksAvailable: 8,
-				},
-				{
-					Name:                   "Skøyen Stasjon",
-					NumberOfBikesAvailable: 7,
-					NumberOfDocksAvailable: 5,
-				},
-				{
-					Name:                   "Sotahjørnet",
-					NumberOfBikesAvailable: 4,
-					NumberOfDocksAvailable: 9,
-				},
+			ExpectedFeeds: map[string]string{"station_status": "https://nb"},
+		},
+		{
+			// The user prefers English
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{"data": {"en": {"feeds": [{"name": "station_status", "url": "https://en"}]}, "nb": {"feeds": [{"name": "station_status", "url": "https://nb"}]}}}`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
+				ExpectError:            false,
+			},
+			Accept:        "en",
+			ExpectedFeeds: map[string]string{"station_status": "https://en"},
+		},
+		{
+			// No languages
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{"data": {}}`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
+				ExpectError:            true,
+			},
+			ExpectedFeeds: nil,
+		},
+		{
+			// Garbled response data
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{$#`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
+				ExpectError:            true,
+			},
+			ExpectedFeeds: nil,
+		},
+		{
+			// Not Found
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusNotFound,
+				ResponseBody:           `Not Found`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/gbfs.json",
+				ExpectError:            true,
+			},
+			ExpectedFeeds: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			verifyFetchRequest(t, testCase.ExpectedRequestAddress, request)
+			return &http.Response{
+				StatusCode: testCase.ResponseStatusCode,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.ResponseBody)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		feeds, err := discoverFeeds(context.Background(), providers["oslo"].DiscoveryAddress, testCase.Accept)
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error")
+		}
+
+		if !reflect.DeepEqual(feeds, testCase.ExpectedFeeds) {
+			t.Errorf("The discovered feeds %v are different from the expected feeds %v", feeds, testCase.ExpectedFeeds)
+		}
+	}
+}
+
+func TestPickLanguage(t *testing.T) {
+
+	testCases := []testPickLanguageCase{
+		{
+			// Exact match
+			Accept:    "en",
+			Available: []string{"nb", "en"},
+			Expected:  "en",
+		},
+		{
+			// Exact match, ignoring case and q-values
+			Accept:    "EN;q=0.8",
+			Available: []string{"nb", "en"},
+			Expected:  "en",
+		},
+		{
+			// The first preferred language that is available wins
+			Accept:    "de, en, nb",
+			Available: []string{"nb", "en"},
+			Expected:  "en",
+		},
+		{
+			// Prefix match with a region
+			Accept:    "en-US,en;q=0.9",
+			Available: []string{"nb", "en"},
+			Expected:  "en",
+		},
+		{
+			// Prefix match, the other way around
+			Accept:    "en",
+			Available: []string{"nb", "en-GB"},
+			Expected:  "en-GB",
+		},
+		{
+			// No match, Norwegian is the fallback
+			Accept:    "de",
+			Available: []string{"en", "nb"},
+			Expected:  "nb",
+		},
+		{
+			// No preference and no Norwegian, the first language is the fallback
+			Accept:    "",
+			Available: []string{"sv", "en"},
+			Expected:  "en",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if language := pickLanguage(testCase.Accept, testCase.Available); language != testCase.Expected {
+			t.Errorf("We picked `%s` from %v for `%s`, expected `%s`", language, testCase.Available, testCase.Accept, testCase.Expected)
+		}
+	}
+}
+
+func TestResolveFeeds(t *testing.T) {
+
+	discoveryResponse := `{"data": {"nb": {"feeds": [
+		{"name": "system_information", "url": "https://discovered/system_information.json"},
+		{"name": "station_information", "url": "https://discovered/station_information.json"},
+		{"name": "station_status", "url": "https://discovered/station_status.json"}
+	]}}}`
+
+	testCases := []testResolveFeedsCase{
+		{
+			// No flags, so the discovered feeds are used
+			DiscoveryStatusCode:        http.StatusOK,
+			ExpectedSystemAddress:      "https://discovered/system_information.json",
+			ExpectedInformationAddress: "https://discovered/station_information.json",
+			ExpectedStatusAddress:      "https://discovered/station_status.json",
+			ExpectDiscovery:            true,
+		},
+		{
+			// -information-url wins over the discovered feed
+			DiscoveryStatusCode:        http.StatusOK,
+			Overrides:                  map[string]string{"station_information": "http://localhost:8080/station_information.json"},
+			ExpectedSystemAddress:      "https://discovered/system_information.json",
+			ExpectedInformationAddress: "http://localhost:8080/station_information.json",
+			ExpectedStatusAddress:      "https://discovered/station_status.json",
+			ExpectDiscovery:            true,
+		},
+		{
+			// -status-url wins over the discovered feed
+			DiscoveryStatusCode:        http.StatusOK,
+			Overrides:                  map[string]string{"station_status": "http://localhost:8080/station_status.json"},
+			ExpectedSystemAddress:      "https://discovered/system_information.json",
+			ExpectedInformationAddress: "https://discovered/station_information.json",
+			ExpectedStatusAddress:      "http://localhost:8080/station_status.json",
+			ExpectDiscovery:            true,
+		},
+		{
+			// -system-url wins over the discovered feed
+			DiscoveryStatusCode:        http.StatusOK,
+			Overrides:                  map[string]string{"system_information": "http://localhost:8080/system_information.json"},
+			ExpectedSystemAddress:      "http://localhost:8080/system_information.json",
+			ExpectedInformationAddress: "https://discovered/station_information.json",
+			ExpectedStatusAddress:      "https://discovered/station_status.json",
+			ExpectDiscovery:            true,
+		},
+		{
+			// Auto-discovery fails, so the flags win over the feeds we know
+			DiscoveryStatusCode:        http.StatusInternalServerError,
+			Overrides:                  map[string]string{"station_status": "http://localhost:8080/station_status.json"},
+			ExpectedSystemAddress:      providers["oslo"].SystemInformationAddress,
+			ExpectedInformationAddress: providers["oslo"].StationInformationAddress,
+			ExpectedStatusAddress:      "http://localhost:8080/station_status.json",
+			ExpectDiscovery:            true,
+		},
+		{
+			// Both station feeds are overridden, so we don't ask the real system for anything
+			DiscoveryStatusCode: http.StatusOK,
+			Overrides: map[string]string{
+				"station_information": "http://localhost:8080/station_information.json",
+				"station_status":      "http://localhost:8080/station_status.json",
+			},
+			ExpectedSystemAddress:      "",
+			ExpectedInformationAddress: "http://localhost:8080/station_information.json",
+			ExpectedStatusAddress:      "http://localhost:8080/station_status.json",
+			ExpectDiscovery:            false,
+		},
+		{
+			// All three feeds are overridden
+			DiscoveryStatusCode: http.StatusOK,
+			Overrides: map[string]string{
+				"system_information":  "http://localhost:8080/system_information.json",
+				"station_information": "http://localhost:8080/station_information.json",
+				"station_status":      "http://localhost:8080/station_status.json",
 			},
+			ExpectedSystemAddress:      "http://localhost:8080/system_information.json",
+			ExpectedInformationAddress: "http://localhost:8080/station_information.json",
+			ExpectedStatusAddress:      "http://localhost:8080/station_status.json",
+			ExpectDiscovery:            false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		discovered := false
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			discovered = true
+			return &http.Response{
+				StatusCode: testCase.DiscoveryStatusCode,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(discoveryResponse)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		p, err := resolveFeeds(context.Background(), providers["oslo"], "", testCase.Overrides)
+
+		// A failed auto-discovery is returned, even though we fall back to the feeds we know
+		if failed := testCase.DiscoveryStatusCode != http.StatusOK && testCase.ExpectDiscovery; failed != (err != nil) {
+			t.Errorf("We got the error %v, expected an error: %t", err, failed)
+		}
+
+		if discovered != testCase.ExpectDiscovery {
+			t.Errorf("We asked for the auto-discovery file: %t, expected %t", discovered, testCase.ExpectDiscovery)
+		}
+		if p.SystemInformationAddress != testCase.ExpectedSystemAddress {
+			t.Errorf("The system information address `%s` is different from the expected `%s`", p.SystemInformationAddress, testCase.ExpectedSystemAddress)
+		}
+		if p.StationInformationAddress != testCase.ExpectedInformationAddress {
+			t.Errorf("The station information address `%s` is different from the expected `%s`", p.StationInformationAddress, testCase.ExpectedInformationAddress)
+		}
+		if p.StationStatusAddress != testCase.ExpectedStatusAddress {
+			t.Errorf("The station status address `%s` is different from the expected `%s`", p.StationStatusAddress, testCase.ExpectedStatusAddress)
+		}
+	}
+}
+
+func TestProviderWithFeeds(t *testing.T) {
+
+	original := providers["oslo"]
+
+	// Only the station feeds we know about are replaced
+	updated := original.withFeeds(map[string]string{
+		"station_status":     "https://example.com/status.json",
+		"system_information": "https://example.com/system.json",
+	})
+
+	if updated.StationStatusAddress != "https://example.com/status.json" {
+		t.Errorf("The station status address `%s` was not replaced", updated.StationStatusAddress)
+	}
+
+	if updated.StationInformationAddress != original.StationInformationAddress {
+		t.Errorf("The station information address `%s` should not have changed", updated.StationInformationAddress)
+	}
+
+	if providers["oslo"].StationStatusAddress != original.StationStatusAddress {
+		t.Errorf("The registered provider was modified")
+	}
+}
+
+func TestFetchSystemInformation(t *testing.T) {
+
+	systemInformationResponse, err := ioutil.ReadFile("main_testdata/system_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	testCases := []testFetchSystemInformationCase{
+		{
+			// Happy path
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(systemInformationResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/system_information.json",
+				ExpectError:            false,
+			},
+			ExpectedInformation: gbfsSystemInformation{
+				LastUpdated: 1553592653,
+				Data: gbfsSystemInformationData{
+					SystemID:    "oslobysykkel",
+					Language:    "nb",
+					Name:        "Oslo Bysykkel",
+					Operator:    "UIP Oslo Bysykkel AS",
+					Timezone:    "Europe/Oslo",
+					PhoneNumber: "+4791589700",
+					Email:       "post@oslobysykkel.no",
+				},
+			},
+		},
+		{
+			// Garbled response data
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{$#`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/system_information.json",
+				ExpectError:            true,
+			},
+			ExpectedInformation: gbfsSystemInformation{},
+		},
+		{
+			// Internal Server Error
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/system_information.json",
+				ExpectError:            true,
+			},
+			ExpectedInformation: gbfsSystemInformation{},
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			verifyFetchRequest(t, testCase.ExpectedRequestAddress, request)
+			return &http.Response{
+				StatusCode: testCase.ResponseStatusCode,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.ResponseBody)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		systemInformation, err := fetchSystemInformation(context.Background(), providers["oslo"].SystemInformationAddress)
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error")
+		}
+
+		if !reflect.DeepEqual(systemInformation, testCase.ExpectedInformation) {
+			t.Errorf("The received system information is different from the expected system information")
+		}
+	}
+}
+
+func TestFetchStationInformation(t *testing.T) {
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	testCases := []testFetchStationInformationCase{
+		{
+			// Happy path
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationInformationResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            false,
+			},
+			ExpectedInformation: gbfsStationInformation{
+				LastUpdated: 1553592653,
+				Data: gbfsStationInformationData{
+					Stations: []gbfsStationInformationStation{
+						{
+							StationID: "627",
+							Name:      "Skøyen Stasjon",
+							Address:   "Skøyen Stasjon",
+							Latitude:  59.9226729,
+							Longitude: 10.6788129,
+							Capacity:  20,
+						},
+						{
+							StationID: "623",
+							Name:      "7 Juni Plassen",
+							Address:   "7 Juni Plassen",
+							Latitude:  59.9150596,
+							Longitude: 10.7312715,
+							Capacity:  15,
+						},
+						{
+							StationID: "610",
+							Name:      "Sotahjørnet",
+							Address:   "Sotahjørnet",
+							Latitude:  59.9099822,
+							Longitude: 10.7914482,
+							Capacity:  20,
+						},
+					},
+				},
+			},
+		},
+		{
+			// Empty response data
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           ``,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedInformation: gbfsStationInformation{},
+		},
+		{
+			// Garbled response data
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{$#`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedInformation: gbfsStationInformation{},
+		},
+		{
+			// Internal Server Error
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedInformation: gbfsStationInformation{},
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			verifyFetchRequest(t, testCase.ExpectedRequestAddress, request)
+			return &http.Response{
+				StatusCode: testCase.ResponseStatusCode,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.ResponseBody)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		information, err := fetchStationInformation(context.Background(), providers["oslo"].StationInformationAddress)
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error")
+		}
+
+		if !reflect.DeepEqual(information, testCase.ExpectedInformation) {
+			t.Errorf("The received station information is different from the expected station information")
+		}
+	}
+}
+
+func TestFetchStationStatus(t *testing.T) {
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	testCases := []testFetchStationStatusCase{
+		{
+			// Happy path
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationStatusResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            false,
+			},
+			ExpectedStatus: gbfsStationStatus{
+				LastUpdated: 1540219230,
+				Data: gbfsStationStatusData{
+					Stations: []gbfsStationStatusStation{
+						{
+							StationID:              "627",
+							NumberOfBikesAvailable: 7,
+							NumberOfBikesDisabled:  1,
+							NumberOfDocksAvailable: 5,
+							NumberOfDocksDisabled:  2,
+							IsInstalled:            1,
+							IsRenting:              1,
+							IsReturning:            1,
+							LastReported:           1540215630,
+						},
+						{
+							StationID:              "623",
+							NumberOfBikesAvailable: 4,
+							NumberOfDocksAvailable: 8,
+							IsInstalled:            1,
+							IsRenting:              1,
+							IsReturning:            1,
+							LastReported:           1540219230,
+						},
+						{
+							StationID:              "610",
+							NumberOfBikesAvailable: 4,
+							NumberOfDocksAvailable: 9,
+							IsInstalled:            1,
+							IsRenting:              1,
+							IsReturning:            1,
+							LastReported:           1540219230,
+						},
+					},
+				},
+			},
+		},
+		{
+			// Empty response data
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           ``,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			ExpectedStatus: gbfsStationStatus{},
+		},
+		{
+			// Garbled response data
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{$#`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			ExpectedStatus: gbfsStationStatus{},
+		},
+		{
+			// Internal Server Error
+			testFetchCase: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			ExpectedStatus: gbfsStationStatus{},
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			verifyFetchRequest(t, testCase.ExpectedRequestAddress, request)
+			return &http.Response{
+				StatusCode: testCase.ResponseStatusCode,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.ResponseBody)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		status, err := fetchStationStatus(context.Background(), providers["oslo"].StationStatusAddress)
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error")
+		}
+
+		if !reflect.DeepEqual(status, testCase.ExpectedStatus) {
+			t.Errorf("The received station status is different from the expected station status")
+		}
+	}
+}
+
+func TestFetchStationStatusMalformed(t *testing.T) {
+
+	// Station 623 has a string where we expect a number
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status_malformed.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(stationStatusResponse)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	stationStatus, err := fetchStationStatus(context.Background(), providers["oslo"].StationStatusAddress)
+
+	if err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
+	}
+
+	if stationStatus.Data.Malformed != 1 {
+		t.Errorf("We counted %d malformed stations, expected 1", stationStatus.Data.Malformed)
+	}
+
+	stationIDs := make([]string, 0, len(stationStatus.Data.Stations))
+	for _, station := range stationStatus.Data.Stations {
+		stationIDs = append(stationIDs, station.StationID)
+	}
+	if expected := []string{"627", "610"}; !reflect.DeepEqual(stationIDs, expected) {
+		t.Errorf("We got the stations %v, expected the well-formed stations %v", stationIDs, expected)
+	}
+}
+
+func TestFetchData(t *testing.T) {
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	testCases := []testFetchDataCase{
+		{
+			// Happy path
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationStatusResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            false,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationInformationResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            false,
+			},
+			ExpectedData: []stationData{
+				{
+					StationID:              "623",
+					Name:                   "7 Juni Plassen",
+					Address:                "7 Juni Plassen",
+					NumberOfBikesAvailable: 4,
+					NumberOfDocksAvailable: 8,
+					Capacity:               15,
+					Latitude:               59.9150596,
+					Longitude:              10.7312715,
+					IsInstalled:            true,
+					IsRenting:              true,
+					IsReturning:            true,
+					LastReported:           time.Unix(1540219230, 0),
+				},
+				{
+					StationID:              "627",
+					Name:                   "Skøyen Stasjon",
+					Address:                "Skøyen Stasjon",
+					NumberOfBikesAvailable: 7,
+					NumberOfDocksAvailable: 5,
+					NumberOfBikesDisabled:  1,
+					NumberOfDocksDisabled:  2,
+					Capacity:               20,
+					Latitude:               59.9226729,
+					Longitude:              10.6788129,
+					IsInstalled:            true,
+					IsRenting:              true,
+					IsReturning:            true,
+					LastReported:           time.Unix(1540215630, 0),
+				},
+				{
+					StationID:              "610",
+					Name:                   "Sotahjørnet",
+					Address:                "Sotahjørnet",
+					NumberOfBikesAvailable: 4,
+					NumberOfDocksAvailable: 9,
+					Capacity:               20,
+					Latitude:               59.9099822,
+					Longitude:              10.7914482,
+					IsInstalled:            true,
+					IsRenting:              true,
+					IsReturning:            true,
+					LastReported:           time.Unix(1540219230, 0),
+				},
+			},
+			ExpectedStats: fetchStats{
+				TotalStations: 3,
+				MissingStatus: 0,
+				// The status feed is the oldest of the two
+				LastUpdated: time.Unix(1540219230, 0),
+				FeedSkew:    (1553592653 - 1540219230) * time.Second,
+			},
+		},
+		{
+			// Empty station status response data
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           ``,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationInformationResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            false,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Empty station information response data
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationStatusResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            false,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           ``,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Empty station status and information response data
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           ``,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           ``,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Garbled station status response data
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{#$`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationInformationResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            false,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Garbled station information response data
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationStatusResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            false,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{#$`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Garbled station status and information response data
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{#$`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           `{#$`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Internal Server Error station status response
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationInformationResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            false,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Internal Server Error station information response
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusOK,
+				ResponseBody:           string(stationStatusResponse),
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            false,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedData: nil,
+		},
+		{
+			// Internal Server Error for both station status and information responses
+			FetchStatus: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
+				ExpectError:            true,
+			},
+			FetchInformation: testFetchCase{
+				ResponseStatusCode:     http.StatusInternalServerError,
+				ResponseBody:           `Internal Server Error`,
+				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
+				ExpectError:            true,
+			},
+			ExpectedData: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+
+			switch request.URL.String() {
+
+			case testCase.FetchStatus.ExpectedRequestAddress:
+				verifyFetchRequest(t, testCase.FetchStatus.ExpectedRequestAddress, request)
+				return &http.Response{
+					StatusCode: testCase.FetchStatus.ResponseStatusCode,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.FetchStatus.ResponseBody)),
+					Header:     make(http.Header),
+				}
+
+			case testCase.FetchInformation.ExpectedRequestAddress:
+				verifyFetchRequest(t, testCase.FetchInformation.ExpectedRequestAddress, request)
+				return &http.Response{
+					StatusCode: testCase.FetchInformation.ResponseStatusCode,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.FetchInformation.ResponseBody)),
+					Header:     make(http.Header),
+				}
+
+			default:
+				t.Errorf("The request URL `%s` did not match any of the expected URLs", request.URL.String())
+
+			}
+
+			return &http.Response{}
+		})}
+
+		stations, stats, err := fetchData(context.Background(), providers["oslo"])
+
+		if !testCase.FetchStatus.ExpectError && !testCase.FetchInformation.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if (testCase.FetchStatus.ExpectError || testCase.FetchInformation.ExpectError) && err == nil {
+			t.Errorf("We did not receive the expected error")
+		}
+
+		if !reflect.DeepEqual(stations, testCase.ExpectedData) {
+			t.Errorf("The received stations data is different from the expected stations data")
+		}
+
+		if !reflect.DeepEqual(stats, testCase.ExpectedStats) {
+			t.Errorf("The received stats %+v are different from the expected stats %+v", stats, testCase.ExpectedStats)
+		}
+	}
+}
+
+func TestFetchDataMissingStatus(t *testing.T) {
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	// Only one of the three stations has status
+	const stationStatusResponse = `{"last_updated": 1540219230, "data": {"stations": [{"station_id": "627", "num_bikes_available": 7, "num_docks_available": 5}]}}`
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		body := stationStatusResponse
+		if request.URL.String() == providers["oslo"].StationInformationAddress {
+			body = string(stationInformationResponse)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	stations, stats, err := fetchData(context.Background(), providers["oslo"])
+
+	if err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
+	}
+
+	if len(stations) != 1 || stations[0].StationID != "627" {
+		t.Errorf("We got the stations %v, expected only station 627", stations)
+	}
+
+	if stats.TotalStations != 3 || stats.MissingStatus != 2 {
+		t.Errorf("We got %d of %d stations missing status, expected 2 of 3", stats.MissingStatus, stats.TotalStations)
+	}
+}
+
+func TestFetchDataPartial(t *testing.T) {
+
+	defer func(partial bool) { allowPartial = partial }(allowPartial)
+	allowPartial = true
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	transport := func(failingAddress string) CustomTransport {
+		return CustomTransport(func(request *http.Request) *http.Response {
+			if request.URL.String() == failingAddress {
+				return &http.Response{
+					StatusCode: http.StatusInternalServerError,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+					Header:     make(http.Header),
+				}
+			}
+			body := stationStatusResponse
+			if request.URL.String() == providers["oslo"].StationInformationAddress {
+				body = stationInformationResponse
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBuffer(body)),
+				Header:     make(http.Header),
+			}
+		})
+	}
+
+	// The status feed fails, so we get the stations without availability
+	client = &http.Client{Transport: transport(providers["oslo"].StationStatusAddress)}
+
+	stations, stats, err := fetchData(context.Background(), providers["oslo"])
+
+	if err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
+	}
+
+	if len(stations) != 3 {
+		t.Errorf("We got %d stations, expected 3", len(stations))
+	}
+
+	for _, station := range stations {
+		if !station.StatusMissing || station.NumberOfBikesAvailable != 0 || station.NumberOfDocksAvailable != 0 {
+			t.Errorf("The station %+v should be missing status and availability", station)
+		}
+	}
+
+	if stats.MissingStatus != 3 || stats.TotalStations != 3 {
+		t.Errorf("We got %d of %d stations missing status, expected 3 of 3", stats.MissingStatus, stats.TotalStations)
+	}
+
+	// We don't know how fresh the availability is
+	if !stats.StatusFailed || !stats.LastUpdated.IsZero() {
+		t.Errorf("The stats %+v should tell that the status failed, without a last updated time", stats)
+	}
+
+	// Without the station information there is nothing to show
+	client = &http.Client{Transport: transport(providers["oslo"].StationInformationAddress)}
+
+	if _, _, err := fetchData(context.Background(), providers["oslo"]); err == nil {
+		t.Errorf("We did not receive the expected error")
+	}
+}
+
+func TestFetchDataDuplicateStations(t *testing.T) {
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	// Station 627 is listed twice, with different availability
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status_duplicate.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		body := stationStatusResponse
+		if request.URL.String() == providers["oslo"].StationInformationAddress {
+			body = stationInformationResponse
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(body)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	stations, stats, err := fetchData(context.Background(), providers["oslo"])
+
+	if err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
+	}
+
+	if stats.DuplicateStations != 1 {
+		t.Errorf("We counted %d duplicate stations, expected 1", stats.DuplicateStations)
+	}
+
+	if len(stations) != 3 {
+		t.Fatalf("We got %d stations, expected 3", len(stations))
+	}
+
+	// The last one in the feed wins
+	for _, station := range stations {
+		if station.StationID == "627" && (station.NumberOfBikesAvailable != 6 || station.NumberOfDocksAvailable != 6) {
+			t.Errorf("We got %d bikes and %d docks for station 627, expected the last status with 6 and 6",
+				station.NumberOfBikesAvailable, station.NumberOfDocksAvailable)
+		}
+	}
+}
+
+func TestFetchDataFeedSkew(t *testing.T) {
+
+	// The information feed is ten minutes newer than the status feed
+	const stationInformationResponse = `{"last_updated": 1540219830, "data": {"stations": [{"station_id": "627", "name": "Skøyen Stasjon", "capacity": 20}]}}`
+	const stationStatusResponse = `{"last_updated": 1540219230, "data": {"stations": [{"station_id": "627", "num_bikes_available": 7, "num_docks_available": 5}]}}`
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		body := stationStatusResponse
+		if request.URL.String() == providers["oslo"].StationInformationAddress {
+			body = stationInformationResponse
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	_, stats, err := fetchData(context.Background(), providers["oslo"])
+
+	if err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
+	}
+
+	if stats.FeedSkew != 10*time.Minute {
+		t.Errorf("The feed skew %s is different from the expected %s", stats.FeedSkew, 10*time.Minute)
+	}
+
+	if stats.LastUpdated != time.Unix(1540219230, 0) {
+		t.Errorf("The last updated time %s is not the time of the oldest feed", stats.LastUpdated)
+	}
+}
+
+func TestFetchDataMalformedStations(t *testing.T) {
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	// Station 623 has a string where we expect a number
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status_malformed.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		body := stationStatusResponse
+		if request.URL.String() == providers["oslo"].StationInformationAddress {
+			body = stationInformationResponse
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(body)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	stations, stats, err := fetchData(context.Background(), providers["oslo"])
+
+	if err != nil {
+		t.Errorf("We got an unexpected error: %s", err.Error())
+	}
+
+	if stats.MalformedStations != 1 || stats.MissingStatus != 1 {
+		t.Errorf("We counted %d malformed and %d missing stations, expected 1 and 1", stats.MalformedStations, stats.MissingStatus)
+	}
+
+	if len(stations) != 2 {
+		t.Errorf("We got %d stations, expected the 2 with a well-formed status", len(stations))
+	}
+}
+
+func TestFetchMessage(t *testing.T) {
+
+	testCases := []testFetchMessageCase{
+		{
+			// Everything is fine
+			Stats:           fetchStats{TotalStations: 3},
+			ExpectedMessage: "",
+		},
+		{
+			// Some stations are missing status
+			Stats:           fetchStats{TotalStations: 3, MissingStatus: 2},
+			ExpectedMessage: " 🙈 Vi mangler status for 2 av 3 stasjoner. Vent litt, så prøver vi igjen!",
+		},
+		{
+			// Some stations have a malformed status entry, and so are also missing status
+			Stats:           fetchStats{TotalStations: 3, MissingStatus: 1, MalformedStations: 1},
+			ExpectedMessage: " 🧩 Status for 1 stasjoner var ugyldig, så de vises ikke. Vent litt, så prøver vi igjen!",
+		},
+		{
+			// Some stations are listed twice
+			Stats:           fetchStats{TotalStations: 3, DuplicateStations: 1},
+			ExpectedMessage: " 👯 1 stasjoner er oppført mer enn én gang. Vi viser den siste av dem.",
+		},
+		{
+			// The feeds are updated a few seconds apart, which is normal
+			Stats:           fetchStats{TotalStations: 3, FeedSkew: 10 * time.Second},
+			ExpectedMessage: "",
+		},
+		{
+			// The feeds are out of sync
+			Stats:           fetchStats{TotalStations: 3, FeedSkew: 12*time.Minute + 30*time.Second},
+			ExpectedMessage: " ⏳ Status og stasjonsinformasjon er oppdatert med 12 minutters mellomrom. Tallene kan være unøyaktige.",
+		},
+		{
+			// The fetch took too long
+			Error:           &fetchTimeoutError{Timeout: 10 * time.Second, Err: errors.New("Failed")},
+			ExpectedMessage: " 🐢 Det tok for lang tid å hente data. Vent litt, så prøver vi igjen!",
+		},
+		{
+			// The fetch failed
+			Error:           errors.New("Failed"),
+			ExpectedMessage: " 🚒 Vi klarte ikke å hente data. Vent litt, så prøver vi igjen!",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if message := fetchMessage(testCase.Stats, testCase.Error); message != testCase.ExpectedMessage {
+			t.Errorf("The message `%s` is different from the expected `%s`", message, testCase.ExpectedMessage)
+		}
+	}
+}
+
+func TestPollStopsWhenCancelled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := 0
+	done := make(chan struct{})
+
+	go func() {
+		poll(ctx, time.Hour, nil, func() time.Duration {
+			updates++
+			cancel()
+			return 0
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The poll loop did not return after the context was cancelled")
+	}
+
+	if updates != 1 {
+		t.Errorf("The poll loop updated %d times, expected 1", updates)
+	}
+}
+
+func TestPollUpdatesOnEachTick(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := 0
+	done := make(chan struct{})
+
+	go func() {
+		// The first update happens right away, the second one on the first tick
+		poll(ctx, time.Millisecond, nil, func() time.Duration {
+			updates++
+			if updates == 2 {
+				cancel()
+			}
+			return 0
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The poll loop did not return after the context was cancelled")
+	}
+
+	if updates != 2 {
+		t.Errorf("The poll loop updated %d times, expected 2", updates)
+	}
+}
+
+func TestPollBacksOff(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var updated []time.Time
+	done := make(chan struct{})
+
+	go func() {
+		// The first update asks us to wait, even though the interval is shorter
+		poll(ctx, 20*time.Millisecond, nil, func() time.Duration {
+			updated = append(updated, time.Now())
+			if len(updated) == 2 {
+				cancel()
+			}
+			return 50 * time.Millisecond
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The poll loop did not return after the context was cancelled")
+	}
+
+	if len(updated) != 2 {
+		t.Fatalf("The poll loop updated %d times, expected 2", len(updated))
+	}
+
+	if wait := updated[1].Sub(updated[0]); wait < 50*time.Millisecond {
+		t.Errorf("The poll loop waited %s between updates, expected at least %s", wait, 50*time.Millisecond)
+	}
+}
+
+func TestPollCapsBackoff(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := 0
+	done := make(chan struct{})
+
+	go func() {
+		// A bogus Retry-After asks us to wait for a day
+		poll(ctx, time.Millisecond, nil, func() time.Duration {
+			updates++
+			if updates == 2 {
+				cancel()
+			}
+			return 24 * time.Hour
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		cancel()
+		t.Fatalf("The poll loop waited for the whole Retry-After, expected at most %d intervals", maxRetryAfterIntervals)
+	}
+}
+
+func TestPollUpdatesOnRefresh(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	refresh := make(chan struct{})
+	updates := make(chan int)
+	done := make(chan struct{})
+
+	go func() {
+		count := 0
+		poll(ctx, time.Hour, refresh, func() time.Duration {
+			count++
+			updates <- count
+			return 0
+		})
+		close(done)
+	}()
+
+	// The first update happens right away, the second one when we ask for it
+	<-updates
+	refresh <- struct{}{}
+
+	select {
+	case count := <-updates:
+		if count != 2 {
+			t.Errorf("The poll loop updated %d times, expected 2", count)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The poll loop did not update when asked to refresh")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestFetchDataFailsFast(t *testing.T) {
+
+	informationCancelled := make(chan bool, 1)
+
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+
+		if request.URL.String() == providers["oslo"].StationStatusAddress {
+			return &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`Internal Server Error`)),
+				Header:     make(http.Header),
+			}
+		}
+
+		// The information fetch hangs until it is cancelled
+		select {
+		case <-request.Context().Done():
+			informationCancelled <- true
+		case <-time.After(5 * time.Second):
+			informationCancelled <- false
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	_, _, err := fetchData(context.Background(), providers["oslo"])
+
+	if err == nil {
+		t.Errorf("We did not receive the expected error")
+	}
+
+	if !<-informationCancelled {
+		t.Errorf("The information fetch was not cancelled when the status fetch failed")
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+
+	testCases := []testFetchTimeoutCase{
+		{
+			// A single attempt that is done before the next update
+			Interval:       10 * time.Second,
+			RequestTimeout: 5 * time.Second,
+			Attempts:       1,
+			Expected:       10 * time.Second,
+		},
+		{
+			// A single attempt gets its whole request timeout, even with a short update interval
+			Interval:       time.Second,
+			RequestTimeout: 5 * time.Second,
+			Attempts:       1,
+			Expected:       5 * time.Second,
+		},
+		{
+			// Every attempt gets its request timeout, and there is room for the backoff between them
+			Interval:       10 * time.Second,
+			RequestTimeout: 10 * time.Second,
+			Attempts:       3,
+			Expected:       30*time.Second + 1600*time.Millisecond,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if timeout := fetchTimeout(testCase.Interval, testCase.RequestTimeout, testCase.Attempts); timeout != testCase.Expected {
+			t.Errorf("The timeout %s is different from the expected %s", timeout, testCase.Expected)
+		}
+	}
+}
+
+func TestFetchDataTimeout(t *testing.T) {
+
+	defer func(interval, timeout positiveDuration) {
+		updateInterval = interval
+		requestTimeout = timeout
+	}(updateInterval, requestTimeout)
+	updateInterval = positiveDuration(20 * time.Millisecond)
+	requestTimeout = positiveDuration(10 * time.Millisecond)
+
+	// Both fetches hang until they are cancelled
+	client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		<-request.Context().Done()
+		return &http.Response{
+			StatusCode: http.StatusGatewayTimeout,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			Header:     make(http.Header),
+		}
+	})}
+
+	_, _, err := fetchData(context.Background(), providers["oslo"])
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("The error %v does not wrap context.DeadlineExceeded", err)
+	}
+
+	var timeoutErr *fetchTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != 20*time.Millisecond {
+		t.Errorf("The error %v is not a timeout after %s", err, 20*time.Millisecond)
+	}
+
+	// The cause is still there for callers who want it
+	if timeoutErr != nil && errors.Unwrap(timeoutErr) != timeoutErr.Err {
+		t.Errorf("The timeout error does not unwrap to the error from the fetch")
+	}
+}
+
+func TestFetchDataRequestTimeout(t *testing.T) {
+
+	// The update interval is long, so it's the client timeout that stops the fetches, as in production
+	defer func(interval positiveDuration) { updateInterval = interval }(updateInterval)
+	updateInterval = positiveDuration(time.Hour)
+
+	// Both fetches hang until the client gives up
+	client = &http.Client{Timeout: 20 * time.Millisecond, Transport: HangingTransport{}}
+
+	_, _, err := fetchData(context.Background(), providers["oslo"])
+
+	if err == nil {
+		t.Fatalf("We did not receive the expected error")
+	}
+
+	if !isTimeout(err) {
+		t.Errorf("The error %v is not seen as a timeout", err)
+	}
+
+	if message := fetchMessage(fetchStats{}, err); !strings.Contains(message, "🐢") {
+		t.Errorf("The message `%s` does not tell the user that the API is slow", message)
+	}
+}
+
+func TestFetchDataProviders(t *testing.T) {
+
+	stationInformationResponse, err := ioutil.ReadFile("main_testdata/station_information.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	stationStatusResponse, err := ioutil.ReadFile("main_testdata/station_status.json")
+	if err != nil {
+		t.Errorf("Failed to read the test data file: %s", err.Error())
+	}
+
+	testProviders := []provider{
+		{
+			Name:                      "Bysykkel A",
+			StationInformationAddress: "https://a.example.com/station_information.json",
+			StationStatusAddress:      "https://a.example.com/station_status.json",
+		},
+		{
+			Name:                      "Bysykkel B",
+			StationInformationAddress: "https://b.example.com/gbfs/information.json",
+			StationStatusAddress:      "https://b.example.com/gbfs/status.json",
+		},
+	}
+
+	for _, testProvider := range testProviders {
+
+		// Both feeds are fetched concurrently
+		var requestsMutex sync.Mutex
+		requests := 0
+		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+			requestsMutex.Lock()
+			requests++
+			requestsMutex.Unlock()
+
+			body := ""
+			switch request.URL.String() {
+			case testProvider.StationInformationAddress:
+				body = string(stationInformationResponse)
+			case testProvider.StationStatusAddress:
+				body = string(stationStatusResponse)
+			default:
+				t.Errorf("The request URL `%s` does not belong to the provider %s", request.URL.String(), testProvider.Name)
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+				Header:     make(http.Header),
+			}
+		})}
+
+		stations, _, err := fetchData(context.Background(), testProvider)
+
+		if err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if len(stations) != 3 {
+			t.Errorf("We got %d stations from %s, expected 3", len(stations), testProvider.Name)
+		}
+
+		if requests != 2 {
+			t.Errorf("We made %d requests to %s, expected 2", requests, testProvider.Name)
+		}
+	}
+}
+
+func TestApplyFetchResultKeepsStaleData(t *testing.T) {
+
+	defer func() {
+		currentStations, currentUpdated, currentMessage, lastSuccessfulUpdate = nil, time.Time{}, "", time.Time{}
+		currentChanged = nil
+	}()
+
+	stations := []stationData{{StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7}}
+	lastUpdated := time.Unix(1540219230, 0)
+
+	// The first update succeeds
+	applyFetchResult(stations, fetchStats{TotalStations: 1, LastUpdated: lastUpdated}, nil)
+
+	if !reflect.DeepEqual(currentStations, stations) {
+		t.Errorf("The current stations are different from the fetched stations")
+	}
+
+	if lastSuccessfulUpdate.IsZero() {
+		t.Errorf("The time of the last successful update was not set")
+	}
+
+	// The refresh fails
+	applyFetchResult(nil, fetchStats{}, errors.New("Failed"))
+
+	if !reflect.DeepEqual(currentStations, stations) {
+		t.Errorf("The stale stations were not kept after a failed refresh")
+	}
+
+	if !currentUpdated.Equal(lastUpdated) {
+		t.Errorf("The last updated time %s was not kept after a failed refresh", currentUpdated)
+	}
+
+	if !strings.Contains(currentMessage, "Viser data hentet") {
+		t.Errorf("The message `%s` does not tell the user that the data is stale", currentMessage)
+	}
+}
+
+func TestApplySystemInformation(t *testing.T) {
+
+	defer func() { systemData, systemLocation = gbfsSystemInformationData{}, time.Local }()
+
+	// A feed without a time zone keeps local time rather than UTC
+	applySystemInformation(gbfsSystemInformationData{Name: "Oslo Bysykkel"})
+
+	if systemData.Name != "Oslo Bysykkel" || systemLocation != time.Local {
+		t.Errorf("We got %q in %s, expected Oslo Bysykkel in local time", systemData.Name, systemLocation)
+	}
+
+	// UTC is always there, even without a time zone database
+	applySystemInformation(gbfsSystemInformationData{Name: "Oslo Bysykkel", Timezone: "UTC"})
+
+	if systemLocation != time.UTC {
+		t.Errorf("We got the time zone %s, expected UTC", systemLocation)
+	}
+}
+
+func TestApplyFetchResultPartial(t *testing.T) {
+
+	defer func() {
+		currentStations, currentUpdated, currentMessage, lastSuccessfulUpdate = nil, time.Time{}, "", time.Time{}
+		currentChanged = nil
+	}()
+
+	withoutStatus := []stationData{{StationID: "627", Name: "Skøyen Stasjon", StatusMissing: true}}
+	partial := fetchStats{StatusFailed: true, TotalStations: 1, MissingStatus: 1}
+
+	// Without any stations, the ones without status are better than nothing
+	applyFetchResult(withoutStatus, partial, nil)
+
+	if !reflect.DeepEqual(currentStations, withoutStatus) {
+		t.Errorf("The stations without status were not shown when we had nothing else")
+	}
+
+	if !currentUpdated.IsZero() || !lastSuccessfulUpdate.IsZero() {
+		t.Errorf("A fetch without status should not count as an update")
+	}
+
+	// The status comes back
+	stations := []stationData{{StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7}}
+	lastUpdated := time.Unix(1540219230, 0)
+	applyFetchResult(stations, fetchStats{TotalStations: 1, LastUpdated: lastUpdated}, nil)
+
+	if len(currentChanged) != 0 {
+		t.Errorf("The stations %v were highlighted as changed, though we had no status to compare with", currentChanged)
+	}
+
+	// The status fails again, and we keep the last known availability
+	applyFetchResult(withoutStatus, partial, nil)
+
+	if !reflect.DeepEqual(currentStations, stations) {
+		t.Errorf("The last known availability was replaced by stations without status")
+	}
+
+	if !currentUpdated.Equal(lastUpdated) {
+		t.Errorf("The last updated time %s was not kept when the status failed", currentUpdated)
+	}
+
+	if !strings.Contains(currentMessage, "Viser data hentet") {
+		t.Errorf("The message `%s` does not tell the user that the data is stale", currentMessage)
+	}
+}
+
+func TestIsStale(t *testing.T) {
+
+	now := time.Unix(1540219230, 0)
+
+	if isStale(now.Add(-10*time.Second), now, 10*time.Second) {
+		t.Errorf("Data from the last update should not be stale")
+	}
+
+	if isStale(now.Add(-30*time.Second), now, 10*time.Second) {
+		t.Errorf("Data exactly three update intervals old should not be stale")
+	}
+
+	if !isStale(now.Add(-31*time.Second), now, 10*time.Second) {
+		t.Errorf("Data more than three update intervals old should be stale")
+	}
+}
+
+func TestAvailabilityRatio(t *testing.T) {
+
+	if ratio, known := availabilityRatio(5, 20); !known || ratio != 0.25 {
+		t.Errorf("The ratio of 5 of 20 was %f (known %t), expected 0.25", ratio, known)
+	}
+
+	if ratio, known := availabilityRatio(0, 20); !known || ratio != 0 {
+		t.Errorf("The ratio of 0 of 20 was %f (known %t), expected 0", ratio, known)
+	}
+
+	if _, known := availabilityRatio(5, 0); known {
+		t.Errorf("The ratio should be unknown when the capacity is 0")
+	}
+}
+
+func TestSelectStations(t *testing.T) {
+
+	stations := []stationData{
+		{StationID: "627", Name: "Skøyen Stasjon"},
+		{StationID: "623", Name: "7 Juni Plassen"},
+		{StationID: "610", Name: "Sotahjørnet"},
+	}
+
+	// All found, in the order they were asked for
+	selected, missing := selectStations(stations, []string{"610", "627"})
+	if expected := []stationData{stations[2], stations[0]}; !reflect.DeepEqual(selected, expected) {
+		t.Errorf("The selected stations %v are different from the expected %v", selected, expected)
+	}
+	if len(missing) != 0 {
+		t.Errorf("We got the missing IDs %v, expected none", missing)
+	}
+
+	// Some missing
+	selected, missing = selectStations(stations, []string{"999", "623", "1000"})
+	if expected := []stationData{stations[1]}; !reflect.DeepEqual(selected, expected) {
+		t.Errorf("The selected stations %v are different from the expected %v", selected, expected)
+	}
+	if expected := []string{"999", "1000"}; !reflect.DeepEqual(missing, expected) {
+		t.Errorf("The missing IDs %v are different from the expected %v", missing, expected)
+	}
+}
+
+func TestStationsEqual(t *testing.T) {
+
+	a := map[string]stationData{
+		"627": {StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7, NumberOfDocksAvailable: 5},
+		"623": {StationID: "623", Name: "7 Juni Plassen", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 8},
+	}
+
+	equal := map[string]stationData{
+		"627": {StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7, NumberOfDocksAvailable: 5},
+		"623": {StationID: "623", Name: "7 Juni Plassen", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 8},
+	}
+
+	changedValue := map[string]stationData{
+		"627": {StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 6, NumberOfDocksAvailable: 6},
+		"623": {StationID: "623", Name: "7 Juni Plassen", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 8},
+	}
+
+	changedKeys := map[string]stationData{
+		"627": {StationID: "627", Name: "Skøyen Stasjon", NumberOfBikesAvailable: 7, NumberOfDocksAvailable: 5},
+		"610": {StationID: "610", Name: "Sotahjørnet", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 8},
+	}
+
+	if !stationsEqual(a, equal) {
+		t.Errorf("The stations should be equal")
+	}
+
+	if stationsEqual(a, changedValue) {
+		t.Errorf("The stations should not be equal when the availability has changed")
+	}
+
+	if stationsEqual(a, changedKeys) {
+		t.Errorf("The stations should not be equal when a station has been replaced")
+	}
+
+	if stationsEqual(nil, a) || !stationsEqual(nil, map[string]stationData{}) {
+		t.Errorf("Nothing should only be equal to no stations")
+	}
+}
+
+func TestReportAge(t *testing.T) {
+
+	lastUpdated := time.Unix(1540219230, 0)
+
+	if age := reportAge(stationData{LastReported: time.Unix(1540215630, 0)}, lastUpdated); age != time.Hour {
+		t.Errorf("The report age %s is different from the expected %s", age, time.Hour)
+	}
+
+	if age := reportAge(stationData{}, lastUpdated); age != 0 {
+		t.Errorf("A station that has never reported should have no report age, got %s", age)
+	}
+
+	// Clocks differ, and a report after the feed was updated is just fresh
+	if age := reportAge(stationData{LastReported: time.Unix(1540219290, 0)}, lastUpdated); age != 0 {
+		t.Errorf("A report after the feed was updated should have no report age, got %s", age)
+	}
+}
+
+func TestDiffStations(t *testing.T) {
+
+	old := map[string]stationData{
+		"1": {StationID: "1", Name: "Unchanged", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		"2": {StationID: "2", Name: "Bikes changed", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		"3": {StationID: "3", Name: "Docks changed", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		"4": {StationID: "4", Name: "Removed", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		"6": {StationID: "6", Name: "Status recovered", StatusMissing: true},
+	}
+
+	current := map[string]stationData{
+		"1": {StationID: "1", Name: "Unchanged", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		"2": {StationID: "2", Name: "Bikes changed", NumberOfBikesAvailable: 4, NumberOfDocksAvailable: 5},
+		"3": {StationID: "3", Name: "Docks changed", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 6},
+		"5": {StationID: "5", Name: "Added", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		"6": {StationID: "6", Name: "Status recovered", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+	}
+
+	expected := []stationData{current["2"], current["3"], current["5"]}
+	if changed := diffStations(old, current); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("The changed stations %v are different from the expected %v", changed, expected)
+	}
+
+	if changed := diffStations(current, current); len(changed) != 0 {
+		t.Errorf("We got the changed stations %v, expected none", changed)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+
+	stations := []stationData{
+		{StationID: "1", Name: "Empty", NumberOfBikesAvailable: 0, NumberOfDocksAvailable: 10, Capacity: 10},
+		{StationID: "2", Name: "Half", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5, Capacity: 12},
+		{StationID: "3", Name: "Full", NumberOfBikesAvailable: 15, NumberOfDocksAvailable: 0, Capacity: 15},
+	}
+
+	expected := stationSummary{
+		Stations:       3,
+		BikesAvailable: 20,
+		DocksAvailable: 15,
+		Capacity:       37,
+		Empty:          1,
+		Full:           1,
+	}
+
+	if summary := summarize(stations); summary != expected {
+		t.Errorf("The summary %+v is different from the expected summary %+v", summary, expected)
+	}
+
+	if summary := summarize(nil); summary != (stationSummary{}) {
+		t.Errorf("The summary of no stations %+v is not empty", summary)
+	}
+}
+
+func TestFilterStations(t *testing.T) {
+
+	stations := []stationData{
+		{Name: "Empty", NumberOfBikesAvailable: 0, NumberOfDocksAvailable: 10},
+		{Name: "Half", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 5},
+		{Name: "Full", NumberOfBikesAvailable: 10, NumberOfDocksAvailable: 0},
+	}
+
+	testCases := []testFilterStationsCase{
+		{
+			// No filter
+			Filter:           stationFilter{},
+			ExpectedStations: stations,
+		},
+		{
+			// Only stations with bikes
+			Filter:           stationFilter{HasBikes: true},
+			ExpectedStations: []stationData{stations[1], stations[2]},
+		},
+		{
+			// Only stations with docks
+			Filter:           stationFilter{HasDocks: true},
+			ExpectedStations: []stationData{stations[0], stations[1]},
+		},
+		{
+			// Only stations with both bikes and docks
+			Filter:           stationFilter{HasBikes: true, HasDocks: true},
+			ExpectedStations: []stationData{stations[1]},
+		},
+		{
+			// Only empty stations
+			Filter:           stationFilter{Empty: true},
+			ExpectedStations: []stationData{stations[0]},
+		},
+		{
+			// Only full stations
+			Filter:           stationFilter{Full: true},
+			ExpectedStations: []stationData{stations[2]},
+		},
+		{
+			// Stations that are either empty or full
+			Filter:           stationFilter{Empty: true, Full: true},
+			ExpectedStations: []stationData{stations[0], stations[2]},
+		},
+		{
+			// A minimum of zero bikes is no filter at all
+			Filter:           stationFilter{MinBikes: 0},
+			ExpectedStations: stations,
+		},
+		{
+			// At least 3 bikes
+			Filter:           stationFilter{MinBikes: 3},
+			ExpectedStations: []stationData{stations[1], stations[2]},
+		},
+		{
+			// At least 3 bikes and 3 docks
+			Filter:           stationFilter{MinBikes: 3, MinDocks: 3},
+			ExpectedStations: []stationData{stations[1]},
+		},
+		{
+			// More bikes than any station has
+			Filter:           stationFilter{MinBikes: 11},
+			ExpectedStations: []stationData{},
+		},
+		{
+			// Search, ignoring case
+			Filter:           stationFilter{Query: "hALF"},
+			ExpectedStations: []stationData{stations[1]},
+		},
+		{
+			// Search without any matches
+			Filter:           stationFilter{Query: "Skøyen"},
+			ExpectedStations: []stationData{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := filterStations(stations, testCase.Filter)
+		if !reflect.DeepEqual(filtered, testCase.ExpectedStations) {
+			t.Errorf("The filtered stations %v are different from the expected stations %v", filtered, testCase.ExpectedStations)
+		}
+	}
+}
+
+func TestFoldName(t *testing.T) {
+
+	testCases := []testFoldNameCase{
+		{Name: "Skøyen Stasjon", Query: "skøyen", Expected: true},
+		{Name: "Skøyen Stasjon", Query: "skoyen", Expected: true},
+		{Name: "Skøyen Stasjon", Query: "SKOYEN", Expected: true},
+		{Name: "Ålesundgata", Query: "alesund", Expected: true},
+		{Name: "Kværnerbyen", Query: "kvaerner", Expected: true},
+		{Name: "Sotahjørnet", Query: "torg", Expected: false},
+	}
+
+	for _, testCase := range testCases {
+		if matches := strings.Contains(foldName(testCase.Name), foldName(testCase.Query)); matches != testCase.Expected {
+			t.Errorf("Searching for `%s` in `%s` gave %t, expected %t", testCase.Query, testCase.Name, matches, testCase.Expected)
+		}
+	}
+}
+
+func TestSortStations(t *testing.T) {
+
+	stations := []stationData{
+		{StationID: "3", Name: "Bislett", NumberOfBikesAvailable: 2, NumberOfDocksAvailable: 8},
+		{StationID: "1", Name: "Aker Brygge", NumberOfBikesAvailable: 9, NumberOfDocksAvailable: 1},
+		{StationID: "4", Name: "Bislett", NumberOfBikesAvailable: 2, NumberOfDocksAvailable: 3},
+		{StationID: "2", Name: "Carl Berners plass", NumberOfBikesAvailable: 5, NumberOfDocksAvailable: 8},
+	}
+
+	testCases := []testSortStationsCase{
+		{
+			// By name, with station ID as tiebreaker
+			Order:         sortByName,
+			ExpectedOrder: []string{"1", "3", "4", "2"},
+		},
+		{
+			// By available bikes, descending
+			Order:         sortByBikes,
+			ExpectedOrder: []string{"1", "2", "3", "4"},
+		},
+		{
+			// By available docks, descending
+			Order:         sortByDocks,
+			ExpectedOrder: []string{"3", "2", "4", "1"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		sorted := append([]stationData(nil), stations...)
+		sortStations(sorted, testCase.Order)
+
+		order := make([]string, 0, len(sorted))
+		for _, station := range sorted {
+			order = append(order, station.StationID)
+		}
+
+		if !reflect.DeepEqual(order, testCase.ExpectedOrder) {
+			t.Errorf("The sorted station IDs %v are different from the expected %v", order, testCase.ExpectedOrder)
+		}
+	}
+}
+
+func TestSortStationsByFullness(t *testing.T) {
+
+	stations := []stationData{
+		{StationID: "1", Name: "Balansert", NumberOfBikesAvailable: 10, NumberOfDocksAvailable: 10, Capacity: 20},
+		{StationID: "2", Name: "Nesten full", NumberOfBikesAvailable: 19, NumberOfDocksAvailable: 1, Capacity: 20},
+		{StationID: "3", Name: "Nesten tom", NumberOfBikesAvailable: 1, NumberOfDocksAvailable: 9, Capacity: 10},
+		{StationID: "4", Name: "Ukjent kapasitet", NumberOfBikesAvailable: 3, NumberOfDocksAvailable: 3},
+		{StationID: "5", Name: "Uten status", Capacity: 10, StatusMissing: true},
+	}
+
+	testCases := []testSortStationsCase{
+		{
+			// Lowest share of bikes first, unknown last
+			Order:         sortByEmptiest,
+			ExpectedOrder: []string{"3", "1", "2", "4", "5"},
+		},
+		{
+			// Highest share of bikes first, unknown last
+			Order:         sortByFullest,
+			ExpectedOrder: []string{"2", "1", "3", "4", "5"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		sorted := append([]stationData(nil), stations...)
+		sortStations(sorted, testCase.Order)
+
+		order := make([]string, 0, len(sorted))
+		for _, station := range sorted {
+			order = append(order, station.StationID)
+		}
+
+		if !reflect.DeepEqual(order, testCase.ExpectedOrder) {
+			t.Errorf("The sorted station IDs %v are different from the expected %v", order, testCase.ExpectedOrder)
+		}
+	}
+}
+
+func TestNextSortOrder(t *testing.T) {
+
+	testCases := []testNextSortOrderCase{
+		{Current: sortByName, Expected: sortByBikes},
+		{Current: sortByFullest, Expected: sortByName},
+		{Current: sortByFullest, HasPosition: true, Expected: sortByDistance},
+		{Current: sortByFullest, HasIDs: true, Expected: sortAsGiven},
+		{Current: sortByDistance, HasPosition: true, HasIDs: true, Expected: sortAsGiven},
+		{Current: sortAsGiven, HasIDs: true, Expected: sortByName},
+	}
+
+	for _, testCase := range testCases {
+		if next := nextSortOrder(testCase.Current, testCase.HasPosition, testCase.HasIDs); next != testCase.Expected {
+			t.Errorf("The sort order after %s is %s, expected %s", sortOrderNames[testCase.Current], sortOrderNames[next], sortOrderNames[testCase.Expected])
+		}
+	}
+}
+
+func TestSortStationsNorwegian(t *testing.T) {
+
+	stations := []stationData{
+		{StationID: "1", Name: "Økern"},
+		{StationID: "2", Name: "Ålesundgata"},
+		{StationID: "3", Name: "Zoologisk museum"},
+		{StationID: "4", Name: "Ærlig plass"},
+		{StationID: "5", Name: "Aker Brygge"},
+	}
+
+	sortStations(stations, sortByName)
+
+	names := make([]string, 0, len(stations))
+	for _, station := range stations {
+		names = append(names, station.Name)
+	}
+
+	// Byte order would put Å before Æ and Ø
+	expected := []string{"Aker Brygge", "Zoologisk museum", "Ærlig plass", "Økern", "Ålesundgata"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("The sorted names %v are different from the expected %v", names, expected)
+	}
+}
+
+func TestDistanceMeters(t *testing.T) {
+
+	testCases := []testDistanceMetersCase{
+		{
+			// Same place
+			From:     position{Latitude: 59.9226729, Longitude: 10.6788129},
+			To:       position{Latitude: 59.9226729, Longitude: 10.6788129},
+			Expected: 0,
 		},
 		{
-			// Empty station status response data
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           ``,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationInformationResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            false,
-			},
-			ExpectedData: nil,
+			// One degree along a meridian
+			From:     position{Latitude: 59, Longitude: 10},
+			To:       position{Latitude: 60, Longitude: 10},
+			Expected: 111195,
 		},
 		{
-			// Empty station information response data
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationStatusResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            false,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           ``,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedData: nil,
+			// Skøyen Stasjon to 7 Juni Plassen
+			From:     position{Latitude: 59.9226729, Longitude: 10.6788129},
+			To:       position{Latitude: 59.9150596, Longitude: 10.7312715},
+			Expected: 3044,
 		},
 		{
-			// Empty station status and information response data
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           ``,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           ``,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedData: nil,
+			// 7 Juni Plassen to Sotahjørnet
+			From:     position{Latitude: 59.9150596, Longitude: 10.7312715},
+			To:       position{Latitude: 59.9099822, Longitude: 10.7914482},
+			Expected: 3402,
 		},
+	}
+
+	for _, testCase := range testCases {
+		distance := distanceMeters(testCase.From.Latitude, testCase.From.Longitude, testCase.To.Latitude, testCase.To.Longitude)
+		if math.Abs(distance-testCase.Expected) > 1 {
+			t.Errorf("The distance from %v to %v is %f meters, expected about %f meters", testCase.From, testCase.To, distance, testCase.Expected)
+		}
+	}
+}
+
+func TestNearestStations(t *testing.T) {
+
+	stations := []stationData{
+		{StationID: "627", Name: "Skøyen Stasjon", Latitude: 59.9226729, Longitude: 10.6788129},
+		{StationID: "623", Name: "7 Juni Plassen", Latitude: 59.9150596, Longitude: 10.7312715},
+		{StationID: "610", Name: "Sotahjørnet", Latitude: 59.9099822, Longitude: 10.7914482},
+	}
+
+	// Close to Oslo S
+	nearest := nearestStations(stations, position{Latitude: 59.91, Longitude: 10.75}, 2)
+
+	expected := []stationData{stations[1], stations[2]}
+	if !reflect.DeepEqual(nearest, expected) {
+		t.Errorf("The nearest stations %v are different from the expected %v", nearest, expected)
+	}
+}
+
+func TestFormatDistance(t *testing.T) {
+
+	testCases := []testFormatDistanceCase{
+		{Meters: 0, Expected: "0 m"},
+		{Meters: 149.4, Expected: "149 m"},
+		{Meters: 149.5, Expected: "150 m"},
+		{Meters: 999.4, Expected: "999 m"},
+		{Meters: 999.6, Expected: "1,0 km"},
+		{Meters: 2345, Expected: "2,3 km"},
+	}
+
+	for _, testCase := range testCases {
+		if formatted := formatDistance(testCase.Meters); formatted != testCase.Expected {
+			t.Errorf("%f meters was formatted as `%s`, expected `%s`", testCase.Meters, formatted, testCase.Expected)
+		}
+	}
+}
+
+func TestPositionValidate(t *testing.T) {
+
+	testCases := []testPositionValidateCase{
+		{Position: position{Latitude: 59.91, Longitude: 10.75}, ExpectError: false},
+		{Position: position{Latitude: -90, Longitude: 180}, ExpectError: false},
+		{Position: position{Latitude: 90.1, Longitude: 10.75}, ExpectError: true},
+		{Position: position{Latitude: 59.91, Longitude: -180.1}, ExpectError: true},
+	}
+
+	for _, testCase := range testCases {
+		err := testCase.Position.validate()
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error for %v", testCase.Position)
+		}
+	}
+}
+
+func TestPositionFromFlags(t *testing.T) {
+
+	testCases := []testPositionFromFlagsCase{
 		{
-			// Garbled station status response data
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           `{#$`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationInformationResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            false,
-			},
-			ExpectedData: nil,
+			// No position
+			Given: map[string]bool{},
+			Count: defaultNearestCount,
 		},
 		{
-			// Garbled station information response data
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationStatusResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            false,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           `{#$`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedData: nil,
+			// Both -lat and -lon
+			Given:            map[string]bool{"lat": true, "lon": true},
+			Count:            defaultNearestCount,
+			ExpectedPosition: &position{Latitude: 59.91, Longitude: 10.75},
 		},
 		{
-			// Garbled station status and information response data
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           `{#$`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           `{#$`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedData: nil,
+			// Only -lat
+			Given:       map[string]bool{"lat": true},
+			Count:       defaultNearestCount,
+			ExpectError: true,
 		},
 		{
-			// Internal Server Error station status response
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusInternalServerError,
-				ResponseBody:           `Internal Server Error`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationInformationResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            false,
-			},
-			ExpectedData: nil,
+			// Only -lon
+			Given:       map[string]bool{"lon": true},
+			Count:       defaultNearestCount,
+			ExpectError: true,
 		},
 		{
-			// Internal Server Error station information response
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusOK,
-				ResponseBody:           string(stationStatusResponse),
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            false,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusInternalServerError,
-				ResponseBody:           `Internal Server Error`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedData: nil,
+			// -n without a position
+			Given:       map[string]bool{"n": true},
+			Count:       3,
+			ExpectError: true,
 		},
 		{
-			// Internal Server Error for both station status and information responses
-			FetchStatus: testFetchCase{
-				ResponseStatusCode:     http.StatusInternalServerError,
-				ResponseBody:           `Internal Server Error`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_status.json",
-				ExpectError:            true,
-			},
-			FetchInformation: testFetchCase{
-				ResponseStatusCode:     http.StatusInternalServerError,
-				ResponseBody:           `Internal Server Error`,
-				ExpectedRequestAddress: "https://gbfs.urbansharing.com/oslobysykkel.no/station_information.json",
-				ExpectError:            true,
-			},
-			ExpectedData: nil,
+			// -n must be positive
+			Given:       map[string]bool{"lat": true, "lon": true, "n": true},
+			Count:       0,
+			ExpectError: true,
 		},
 	}
 
 	for _, testCase := range testCases {
+		p, err := positionFromFlags(testCase.Given, 59.91, 10.75, testCase.Count)
 
-		client = &http.Client{Transport: CustomTransport(func(request *http.Request) *http.Response {
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
 
-			switch request.URL.String() {
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error for the flags %v", testCase.Given)
+		}
 
-			case testCase.FetchStatus.ExpectedRequestAddress:
-				verifyFetchRequest(t, testCase.FetchStatus.ExpectedRequestAddress, request)
-				return &http.Response{
-					StatusCode: testCase.FetchStatus.ResponseStatusCode,
-					Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.FetchStatus.ResponseBody)),
-					Header:     make(http.Header),
-				}
+		if !reflect.DeepEqual(p, testCase.ExpectedPosition) {
+			t.Errorf("The position %v is different from the expected %v", p, testCase.ExpectedPosition)
+		}
+	}
+}
 
-			case testCase.FetchInformation.ExpectedRequestAddress:
-				verifyFetchRequest(t, testCase.FetchInformation.ExpectedRequestAddress, request)
-				return &http.Response{
-					StatusCode: testCase.FetchInformation.ResponseStatusCode,
-					Body:       ioutil.NopCloser(bytes.NewBufferString(testCase.FetchInformation.ResponseBody)),
-					Header:     make(http.Header),
-				}
+func TestWriteProviders(t *testing.T) {
 
-			default:
-				t.Errorf("The request URL `%s` did not match any of the expected URLs", request.URL.String())
+	var buffer bytes.Buffer
+	if err := writeProviders(&buffer); err != nil {
+		t.Fatalf("We got an unexpected error: %s", err.Error())
+	}
 
-			}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != len(providers) {
+		t.Fatalf("We listed %d providers, expected %d", len(lines), len(providers))
+	}
 
-			return &http.Response{}
-		})}
+	// Sorted by the name used with -provider
+	expected := []string{"bergen", "oslo", "trondheim"}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if fields[0] != expected[i] {
+			t.Errorf("The provider `%s` is different from the expected `%s`", fields[0], expected[i])
+		}
+		if address := fields[len(fields)-1]; address != providers[expected[i]].DiscoveryAddress {
+			t.Errorf("The address `%s` is different from the expected `%s`", address, providers[expected[i]].DiscoveryAddress)
+		}
+	}
+}
 
-		stations, _, err := fetchData()
+func TestContactLine(t *testing.T) {
 
-		if !testCase.FetchStatus.ExpectError && !testCase.FetchInformation.ExpectError && err != nil {
+	testCases := []testContactLineCase{
+		{
+			// Phone number and email
+			System:   gbfsSystemInformationData{Operator: "UIP Oslo Bysykkel AS", PhoneNumber: "+4791589700", Email: "post@oslobysykkel.no"},
+			Expected: " Drives av UIP Oslo Bysykkel AS\t ☎ +4791589700  ✉ post@oslobysykkel.no",
+		},
+		{
+			// Only email
+			System:   gbfsSystemInformationData{Operator: "UIP Oslo Bysykkel AS", Email: "post@oslobysykkel.no"},
+			Expected: " Drives av UIP Oslo Bysykkel AS\t ✉ post@oslobysykkel.no",
+		},
+		{
+			// Only phone number
+			System:   gbfsSystemInformationData{Operator: "UIP Oslo Bysykkel AS", PhoneNumber: "+4791589700"},
+			Expected: " Drives av UIP Oslo Bysykkel AS\t ☎ +4791589700",
+		},
+		{
+			// No contact information
+			System:   gbfsSystemInformationData{Operator: "UIP Oslo Bysykkel AS"},
+			Expected: " Drives av UIP Oslo Bysykkel AS\t",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if line := contactLine(testCase.System); line != testCase.Expected {
+			t.Errorf("The contact line `%s` is different from the expected `%s`", line, testCase.Expected)
+		}
+	}
+}
+
+func TestVersionString(t *testing.T) {
+
+	defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+
+	// Built without -ldflags
+	version, commit, buildTime = "", "", ""
+	if received := versionString(); received != "oslobysykkel dev (commit unknown, built unknown)" {
+		t.Errorf("The version `%s` does not use the defaults", received)
+	}
+
+	version, commit, buildTime = "1.2.0", "eaa390d", "2019-03-26T10:00:00Z"
+	if received := versionString(); received != "oslobysykkel 1.2.0 (commit eaa390d, built 2019-03-26T10:00:00Z)" {
+		t.Errorf("The version `%s` does not use the values set when building", received)
+	}
+}
+
+func TestPositiveDuration(t *testing.T) {
+
+	testCases := []testPositiveDurationCase{
+		{Value: "30s", Expected: 30 * time.Second, ExpectError: false},
+		{Value: "1m30s", Expected: 90 * time.Second, ExpectError: false},
+		{Value: "0s", ExpectError: true},
+		{Value: "-5s", ExpectError: true},
+		{Value: "10", ExpectError: true},
+		{Value: "soon", ExpectError: true},
+	}
+
+	for _, testCase := range testCases {
+		var duration positiveDuration
+		err := duration.Set(testCase.Value)
+
+		if !testCase.ExpectError && err != nil {
 			t.Errorf("We got an unexpected error: %s", err.Error())
 		}
 
-		if (testCase.FetchStatus.ExpectError || testCase.FetchInformation.ExpectError) && err == nil {
-			t.Errorf("We did not receive the expected error")
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error for `%s`", testCase.Value)
 		}
 
-		if !reflect.DeepEqual(stations, testCase.ExpectedData) {
-			t.Errorf("The received stations data is different from the expected stations data")
+		if !testCase.ExpectError && time.Duration(duration) != testCase.Expected {
+			t.Errorf("`%s` was parsed as %s, expected %s", testCase.Value, time.Duration(duration), testCase.Expected)
+		}
+	}
+}
+
+func TestStationIDs(t *testing.T) {
+
+	testCases := []testStationIDsCase{
+		{Value: "627", Expected: stationIDs{"627"}, ExpectError: false},
+		{Value: "627,623,610", Expected: stationIDs{"627", "623", "610"}, ExpectError: false},
+		{Value: " 627, 623 ,", Expected: stationIDs{"627", "623"}, ExpectError: false},
+		{Value: "", ExpectError: true},
+		{Value: " , ", ExpectError: true},
+	}
+
+	for _, testCase := range testCases {
+		var ids stationIDs
+		err := ids.Set(testCase.Value)
+
+		if !testCase.ExpectError && err != nil {
+			t.Errorf("We got an unexpected error: %s", err.Error())
+		}
+
+		if testCase.ExpectError && err == nil {
+			t.Errorf("We did not receive the expected error for `%s`", testCase.Value)
+		}
+
+		if !testCase.ExpectError && !reflect.DeepEqual(ids, testCase.Expected) {
+			t.Errorf("`%s` was parsed as %v, expected %v", testCase.Value, ids, testCase.Expected)
+		}
+	}
+}
+
+func TestIntToBool(t *testing.T) {
+
+	testCases := []testIntToBoolCase{
+		{Value: 0, Expected: false},
+		{Value: 1, Expected: true},
+	}
+
+	for _, testCase := range testCases {
+		if result := intToBool(testCase.Value); result != testCase.Expected {
+			t.Errorf("intToBool(%d) returned %t, expected %t", testCase.Value, result, testCase.Expected)
 		}
 	}
 }